@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
@@ -12,32 +13,121 @@ import (
 )
 
 type Block struct {
+	// Blocks stored before the version was introduced have version 0 and are treated as version 1
+	Version           uint32         `json:"version"`
 	Height            uint           `json:"height"`
 	Hash              []byte         `json:"hash"`
 	Timestamp         int64          `json:"timestamp"`
 	MerkleRoot        []byte         `json:"merkleroot"`
 	PreviousBlockHash []byte         `json:"previousblockhash"`
 	Transactions      []*Transaction `json:"transactions"`
+	// Number of times the proposer of the block was changed because the scheduled proposer was silent
+	View uint32 `json:"view"`
+	// ID of the verifier that proposed the block and its signature over the block hash
+	Proposer  string `json:"proposer"`
+	Signature []byte `json:"signature"`
+	// Approvals of the verifiers attached after the block is proposed, not covered by the hash
+	Certificate *QuorumCertificate `json:"certificate"`
 }
 
-// Creates a new block with given transactions and height
-func NewBlock(txs []*Transaction, previousBlockHash []byte, height uint) *Block {
+// Creates a new block with given transactions and height proposed by the given verifier in the given view
+func NewBlock(txs []*Transaction, previousBlockHash []byte, height uint, view uint32, proposer string) *Block {
 	block := &Block{
+		Version:           CurrentBlockVersion,
 		Height:            uint(height),
 		Timestamp:         time.Now().UnixMilli(),
 		PreviousBlockHash: previousBlockHash,
 		Transactions:      txs,
+		View:              view,
+		Proposer:          proposer,
 	}
 
+	block.MerkleRoot = block.MerkleTree().Root.Hash
+	block.Hash = block.ComputeHash()
+
+	return block
+}
+
+// Header of a block which is sufficient to recompute the block hash without the transactions
+type BlockHeader struct {
+	Version           uint32             `json:"version"`
+	Height            uint               `json:"height"`
+	Hash              []byte             `json:"hash"`
+	Timestamp         int64              `json:"timestamp"`
+	MerkleRoot        []byte             `json:"merkleroot"`
+	PreviousBlockHash []byte             `json:"previousblockhash"`
+	TransactionsHash  []byte             `json:"transactionshash"`
+	View              uint32             `json:"view"`
+	Proposer          string             `json:"proposer"`
+	Signature         []byte             `json:"signature"`
+	Certificate       *QuorumCertificate `json:"certificate"`
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Version:           b.Version,
+		Height:            b.Height,
+		Hash:              b.Hash,
+		Timestamp:         b.Timestamp,
+		MerkleRoot:        b.MerkleRoot,
+		PreviousBlockHash: b.PreviousBlockHash,
+		TransactionsHash:  b.TransactionsHash(),
+		View:              b.View,
+		Proposer:          b.Proposer,
+		Signature:         b.Signature,
+		Certificate:       b.Certificate,
+	}
+}
+
+func (h *BlockHeader) ComputeHash() []byte {
+	if HasRule(h.Version, RuleBinaryBlockHash) {
+		hash := sha256.Sum256(h.Bytes())
+		return hash[:]
+	}
+
+	data := bytes.Join([][]byte{
+		ToByte(int64(h.Height)),
+		ToByte(h.Timestamp),
+		h.PreviousBlockHash,
+		h.MerkleRoot,
+		[]byte(h.Proposer),
+		h.TransactionsHash,
+	}, []byte{})
+
+	// The version is only covered from version 2 so that the hashes of the older blocks do not change
+	if HasRule(h.Version, RuleCanonicalMerkleTree) {
+		data = append(data, ToByte(int64(h.Version))...)
+	}
+
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+// Canonical encoding of the fields of the header covered by the block hash
+func (h *BlockHeader) Bytes() []byte {
+	enc := NewEncoder()
+	enc.WriteUint(uint64(h.Version))
+	enc.WriteUint(uint64(h.Height))
+	enc.WriteInt(h.Timestamp)
+	enc.WriteBytes(h.PreviousBlockHash)
+	enc.WriteBytes(h.MerkleRoot)
+	enc.WriteString(h.Proposer)
+	enc.WriteBytes(h.TransactionsHash)
+	if HasRule(h.Version, RuleViewChanges) {
+		enc.WriteUint(uint64(h.View))
+	}
+	return enc.Bytes()
+}
+
+// Construct the merkle tree of the IDs of the transactions in the block
+func (b *Block) MerkleTree() *MerkleTree {
 	var txHashes [][]byte
-	for _, tx := range txs {
+	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.ID)
 	}
 
-	block.MerkleRoot = NewMerkleTree(txHashes).Root.Hash
-	block.Hash = block.ComputeHash()
-
-	return block
+	return NewMerkleTree(b.Version, txHashes)
 }
 
 func (block *Block) Stringify() string {
@@ -49,6 +139,7 @@ func (block *Block) Stringify() string {
 // Generates the genesis block with hardcoded hashes
 func CreateGenesisBlock() *Block {
 	block := &Block{
+		Version:           BlockVersion1,
 		Height:            1,
 		Timestamp:         0,
 		MerkleRoot:        []byte("0"),
@@ -62,37 +153,244 @@ func CreateGenesisBlock() *Block {
 }
 
 func (b *Block) ComputeHash() []byte {
-	data := bytes.Join([][]byte{
-		ToByte(int64(b.Height)),
-		ToByte(b.Timestamp),
-		b.PreviousBlockHash,
-		b.MerkleRoot,
-	}, []byte{})
+	return b.Header().ComputeHash()
+}
 
-	hash := sha256.Sum256(data)
+// Hash of the complete transactions including their signatures
+// which are not covered by the merkle root of the transaction IDs
+func (b *Block) TransactionsHash() []byte {
+	if HasRule(b.Version, RuleBinaryBlockHash) {
+		enc := NewEncoder()
+		enc.WriteUint(uint64(len(b.Transactions)))
+		for _, tx := range b.Transactions {
+			enc.WriteBytes(tx.ID)
+			enc.WriteBytes(tx.Signature)
+		}
 
-	return hash[:]
+		hash := sha256.Sum256(enc.Bytes())
+		return hash[:]
+	}
+
+	hasher := sha256.New()
+	for _, tx := range b.Transactions {
+		hasher.Write(tx.ID)
+		hasher.Write(tx.Signature)
+	}
+
+	return hasher.Sum(nil)
 }
 
-func (b *Block) Verify(prevBlock *Block, pubKeyMap map[string]ecdsa.PublicKey) bool {
+// Encode the complete block for gossip and storage
+func (b *Block) Encode() []byte {
+	enc := NewEncoder()
+	enc.WriteUint(uint64(b.Version))
+	enc.WriteUint(uint64(b.Height))
+	enc.WriteBytes(b.Hash)
+	enc.WriteInt(b.Timestamp)
+	enc.WriteBytes(b.MerkleRoot)
+	enc.WriteBytes(b.PreviousBlockHash)
+
+	enc.WriteUint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(enc)
+	}
+
+	if HasRule(b.Version, RuleViewChanges) {
+		enc.WriteUint(uint64(b.View))
+	}
+	enc.WriteString(b.Proposer)
+	enc.WriteBytes(b.Signature)
+
+	enc.WriteBool(b.Certificate != nil)
+	if b.Certificate != nil {
+		b.Certificate.encode(enc)
+	}
+
+	return enc.Bytes()
+}
+
+// Decode a block encoded with Encode
+func DecodeBlock(data []byte) (*Block, error) {
+	dec := NewDecoder(data)
+	block := decodeBlock(dec)
+	if err := dec.Finish(); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// Encode a list of blocks
+func EncodeBlocks(blocks []*Block) []byte {
+	enc := NewEncoder()
+	enc.WriteUint(uint64(len(blocks)))
+	for _, block := range blocks {
+		enc.WriteBytes(block.Encode())
+	}
+
+	return enc.Bytes()
+}
+
+// Decode a list of blocks encoded with EncodeBlocks
+func DecodeBlocks(data []byte) ([]*Block, error) {
+	dec := NewDecoder(data)
+	blocks := make([]*Block, 0)
+
+	count := dec.ReadUint()
+	for i := uint64(0); i < count && dec.Err() == nil; i++ {
+		block, err := DecodeBlock(dec.ReadBytes())
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	if err := dec.Finish(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+func decodeBlock(dec *Decoder) *Block {
+	block := &Block{
+		Version:           uint32(dec.ReadUint()),
+		Height:            uint(dec.ReadUint()),
+		Hash:              dec.ReadBytes(),
+		Timestamp:         dec.ReadInt(),
+		MerkleRoot:        dec.ReadBytes(),
+		PreviousBlockHash: dec.ReadBytes(),
+		Transactions:      []*Transaction{},
+	}
+
+	count := dec.ReadUint()
+	for i := uint64(0); i < count && dec.Err() == nil; i++ {
+		block.Transactions = append(block.Transactions, decodeTransaction(dec))
+	}
+
+	if HasRule(block.Version, RuleViewChanges) {
+		block.View = uint32(dec.ReadUint())
+	}
+	block.Proposer = dec.ReadString()
+	block.Signature = dec.ReadBytes()
+
+	if dec.ReadBool() {
+		block.Certificate = decodeQuorumCertificate(dec)
+	}
+
+	return block
+}
+
+// Verify the block against the previous block of the chain, the state of the chain
+// up to the previous block and the verifier scheduled to propose it
+func (b *Block) Verify(prevBlock *Block, state *State, pubKeyMap map[string]ecdsa.PublicKey, roleMap map[string]string, proposer string) bool {
 	// Check if block hash or height are invalid
 	if !bytes.Equal(b.PreviousBlockHash, prevBlock.Hash) || b.Height != prevBlock.Height+1 {
 		return false
 	}
 
-	// Verify all the transactions in the block
+	if state.Height != prevBlock.Height {
+		return false
+	}
+
+	// The version can not go back along the chain, otherwise a proposer could skip the rules of the later versions
+	if b.Version > CurrentBlockVersion || b.Version < prevBlock.Version {
+		return false
+	}
+
+	// The age of the transactions is checked against the timestamp, so a proposer can not move it back or ahead
+	if HasRule(b.Version, RuleForwardTimestamps) {
+		if b.Timestamp <= prevBlock.Timestamp || b.Timestamp > time.Now().UnixMilli()+MaxClockDrift.Milliseconds() {
+			return false
+		}
+	}
+
+	// Check that the block is proposed and signed by the scheduled verifier
+	if proposer == "" || b.Proposer != proposer {
+		return false
+	}
+
+	if !b.VerifySignature(pubKeyMap) {
+		return false
+	}
+
+	// Verify all the transactions in the block, which must be sent by registered nodes
 	for _, tx := range b.Transactions {
-		if !tx.Verify(pubKeyMap[tx.Sender]) {
+		pubKey, ok := pubKeyMap[tx.Sender]
+		if !ok || !tx.Verify(pubKey) {
+			return false
+		}
+	}
+
+	// Reject replayed transactions, the nonces of a sender must increase within the block
+	if HasRule(b.Version, RuleReplayProtection) {
+		nonces := make(map[string]uint64)
+		for _, tx := range b.Transactions {
+			if err := tx.CheckReplayGuard(state.ChainID, b.Timestamp); err != nil {
+				return false
+			}
+
+			nonce, ok := nonces[tx.Sender]
+			if !ok {
+				nonce = state.Nonce(tx.Sender)
+			}
+			if tx.Nonce <= nonce {
+				return false
+			}
+			nonces[tx.Sender] = tx.Nonce
+		}
+	}
+
+	// Check the transitions of the products with the rules of the version of the block
+	if HasRule(b.Version, RuleLifecycleTransitions) {
+		if err := state.CheckTransitions(b.Version, b.Height, b.Transactions, roleMap); err != nil {
 			return false
 		}
 	}
 
 	// Check the MerkleRoot
-	var txHashes [][]byte
-	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+	return bytes.Equal(b.MerkleRoot, b.MerkleTree().Root.Hash)
+}
+
+// Check that the hash of the block matches its contents and is signed by its proposer.
+// The check does not need the state of the chain so it can be done before a block is stored.
+func (b *Block) VerifySignature(pubKeyMap map[string]ecdsa.PublicKey) bool {
+	if !bytes.Equal(b.Hash, b.ComputeHash()) {
+		return false
+	}
+
+	pubKey, ok := pubKeyMap[b.Proposer]
+	if !ok || pubKey.X == nil || pubKey.Y == nil {
+		return false
+	}
+	pubKey.Curve = elliptic.P256()
+
+	return ecdsa.VerifyASN1(&pubKey, b.Hash, b.Signature)
+}
+
+// Number of verifier approvals in the certificate of the block
+func (b *Block) Approvals() int {
+	if b.Certificate == nil {
+		return 0
 	}
-	return bytes.Equal(b.MerkleRoot, NewMerkleTree(txHashes).Root.Hash)
+
+	return len(b.Certificate.Approvals)
+}
+
+// Fork choice rule between the tips of two branches.
+// The tip at the greater height is preferred, then the tip with the most
+// verifier approvals and finally the tip with the lowest hash.
+// The signatures of the approvals of both tips must have been verified.
+func IsPreferredTip(candidate, current *Block) bool {
+	if candidate.Height != current.Height {
+		return candidate.Height > current.Height
+	}
+
+	if candidate.Approvals() != current.Approvals() {
+		return candidate.Approvals() > current.Approvals()
+	}
+
+	return bytes.Compare(candidate.Hash, current.Hash) < 0
 }
 
 func ToByte(num int64) []byte {
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Create a block of the given version above the previous block signed by the proposer
+func newTestBlock(t *testing.T, version uint32, prev *Block, proposer string, key *ecdsa.PrivateKey) *Block {
+	t.Helper()
+
+	block := NewBlock([]*Transaction{}, prev.Hash, prev.Height+1, 0, proposer)
+	block.Timestamp = prev.Timestamp + 1
+	block.Version = version
+	block.MerkleRoot = block.MerkleTree().Root.Hash
+	block.Hash = block.ComputeHash()
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Signature = signature
+	return block
+}
+
+func TestBlockVersionCanNotGoBack(t *testing.T) {
+	key := newTestKey(t)
+	pubKeys := map[string]ecdsa.PublicKey{"v": key.PublicKey}
+
+	genesis := CreateGenesisBlock()
+	state := NewState("test", DefaultLifecycle(), DefaultElection())
+	state.Apply(genesis)
+
+	prev := newTestBlock(t, CurrentBlockVersion, genesis, "v", key)
+	if !prev.Verify(genesis, state, pubKeys, nil, "v") {
+		t.Fatal("block of the current version does not verify")
+	}
+	state.Apply(prev)
+
+	if block := newTestBlock(t, RuleVersion(RuleReplayProtection), prev, "v", key); block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block of an older version than its parent verifies")
+	}
+	if block := newTestBlock(t, CurrentBlockVersion+1, prev, "v", key); block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block of a future version verifies")
+	}
+	if block := newTestBlock(t, CurrentBlockVersion, prev, "v", key); !block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block of the version of its parent does not verify")
+	}
+}
+
+func TestUnknownSenderDoesNotVerify(t *testing.T) {
+	key := newTestKey(t)
+	pubKeys := map[string]ecdsa.PublicKey{"v": key.PublicKey}
+
+	genesis := CreateGenesisBlock()
+	state := NewState("test", DefaultLifecycle(), DefaultElection())
+	state.Apply(genesis)
+
+	tx := NewStakeTransaction("unknown", 1, 1, "test")
+	tx.Signature = []byte("signature")
+	if tx.Verify(ecdsa.PublicKey{}) {
+		t.Error("transaction verifies with an empty key")
+	}
+
+	block := NewBlock([]*Transaction{tx}, genesis.Hash, genesis.Height+1, 0, "v")
+	signature, err := ecdsa.SignASN1(rand.Reader, key, block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Signature = signature
+	if block.Verify(genesis, state, pubKeys, nil, "v") {
+		t.Error("block with a transaction of an unknown sender verifies")
+	}
+
+	approval := &Approval{Verifier: "unknown", BlockHash: block.Hash, Signature: []byte("signature")}
+	if approval.Verify(ecdsa.PublicKey{}) {
+		t.Error("approval verifies with an empty key")
+	}
+}
+
+func TestBlockTimestampsMoveForward(t *testing.T) {
+	key := newTestKey(t)
+	pubKeys := map[string]ecdsa.PublicKey{"v": key.PublicKey}
+
+	genesis := CreateGenesisBlock()
+	state := NewState("test", DefaultLifecycle(), DefaultElection())
+	state.Apply(genesis)
+
+	prev := newTestBlock(t, CurrentBlockVersion, genesis, "v", key)
+	state.Apply(prev)
+
+	stamped := func(version uint32, timestamp int64) *Block {
+		block := newTestBlock(t, version, prev, "v", key)
+		block.Timestamp = timestamp
+		block.Hash = block.ComputeHash()
+		signature, err := ecdsa.SignASN1(rand.Reader, key, block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Signature = signature
+		return block
+	}
+
+	if block := stamped(CurrentBlockVersion, prev.Timestamp); block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block with the timestamp of its parent verifies")
+	}
+	future := time.Now().Add(2 * MaxClockDrift).UnixMilli()
+	if block := stamped(CurrentBlockVersion, future); block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block from the future verifies")
+	}
+	if block := stamped(CurrentBlockVersion, time.Now().UnixMilli()); !block.Verify(prev, state, pubKeys, nil, "v") {
+		t.Error("block with the current time does not verify")
+	}
+}
+
+func TestEveryRuleHasAVersion(t *testing.T) {
+	last := RuleForwardTimestamps
+	for rule := RuleCanonicalMerkleTree; rule <= last; rule++ {
+		if RuleVersion(rule) <= BlockVersion1 || RuleVersion(rule) > CurrentBlockVersion {
+			t.Errorf("rule %d was introduced by version %d", rule, RuleVersion(rule))
+		}
+		if rule > 0 && RuleVersion(rule) < RuleVersion(rule-1) {
+			t.Errorf("rule %d was introduced before the earlier rule", rule)
+		}
+	}
+	if RuleVersion(last) != CurrentBlockVersion {
+		t.Errorf("the last rule was introduced by version %d instead of the current version", RuleVersion(last))
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// BlockPool holds the blocks that are not part of the main chain.
+// These are either blocks of a side chain which forked off the main chain
+// or orphan blocks whose parent has not been received yet.
+type BlockPool struct {
+	mu     sync.RWMutex
+	Blocks map[string]*Block `json:"blocks"`
+}
+
+func NewBlockPool() *BlockPool {
+	bp := &BlockPool{
+		Blocks: make(map[string]*Block),
+	}
+	return bp
+}
+
+func (bp *BlockPool) MarshalJSON() ([]byte, error) {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+
+	return json.Marshal(map[string]interface{}{"blocks": bp.Blocks})
+}
+
+func (bp *BlockPool) Add(block *Block) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.Blocks[hex.EncodeToString(block.Hash)] = block
+}
+
+func (bp *BlockPool) Get(hash []byte) (*Block, bool) {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+
+	block, ok := bp.Blocks[hex.EncodeToString(hash)]
+	return block, ok
+}
+
+// Number of blocks in the pool
+func (bp *BlockPool) Size() int {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+
+	return len(bp.Blocks)
+}
+
+func (bp *BlockPool) Remove(block *Block) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	delete(bp.Blocks, hex.EncodeToString(block.Hash))
+}
+
+// Get the blocks in the pool whose parent is the block with the given hash
+func (bp *BlockPool) Children(hash []byte) []*Block {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+
+	children := make([]*Block, 0)
+	for _, block := range bp.Blocks {
+		if bytes.Equal(block.PreviousBlockHash, hash) {
+			children = append(children, block)
+		}
+	}
+
+	return children
+}
+
+// Get the most preferred tip among the block and all of its descendants in the pool
+func (bp *BlockPool) BestDescendant(block *Block) *Block {
+	best := block
+	for _, child := range bp.Children(block.Hash) {
+		if tip := bp.BestDescendant(child); IsPreferredTip(tip, best) {
+			best = tip
+		}
+	}
+
+	return best
+}
+
+// Remove the block and all of its descendants from the pool
+func (bp *BlockPool) RemoveWithDescendants(block *Block) {
+	for _, child := range bp.Children(block.Hash) {
+		bp.RemoveWithDescendants(child)
+	}
+	bp.Remove(block)
+}
+
+// Remove the blocks at or below the given height which can no longer cause a reorganization
+func (bp *BlockPool) Prune(height uint) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for hash, block := range bp.Blocks {
+		if block.Height <= height {
+			delete(bp.Blocks, hash)
+		}
+	}
+}
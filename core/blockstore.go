@@ -0,0 +1,25 @@
+package core
+
+import "errors"
+
+var (
+	ErrBlockNotFound   = errors.New("block not found")
+	ErrBlockNotOnTip   = errors.New("block does not extend the tip of the chain")
+	ErrBlockStoreEmpty = errors.New("block store is empty")
+)
+
+// BlockStore stores the blocks of the chain and indexes them by height and hash
+type BlockStore interface {
+	// Append the block to the tip of the chain
+	Append(block *Block) error
+	// Get the block at the given height
+	GetByHeight(height uint) (*Block, error)
+	// Get the block with the given hash
+	GetByHash(hash []byte) (*Block, error)
+	// Get the last block of the chain, nil if the store is empty
+	Tip() *Block
+	// Remove all the blocks above the given height and return them in ascending order
+	Truncate(height uint) ([]*Block, error)
+	// Release the resources held by the store
+	Close() error
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// Domain separator so that an approval signature can not be mistaken for any other signature over the block hash
+var approvalDomain = []byte("scms.block.approval")
+
+// Approval of a block by a verifier
+type Approval struct {
+	Verifier  string `json:"verifier"`
+	BlockHash []byte `json:"blockhash"`
+	Signature []byte `json:"signature"`
+}
+
+// The digest signed by a verifier to approve the block with the given hash
+func ApprovalDigest(blockHash []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{approvalDomain, blockHash}, []byte{}))
+	return hash[:]
+}
+
+func (a *Approval) Verify(pubKey ecdsa.PublicKey) bool {
+	if pubKey.X == nil || pubKey.Y == nil {
+		return false
+	}
+	pubKey.Curve = elliptic.P256()
+
+	return ecdsa.VerifyASN1(&pubKey, ApprovalDigest(a.BlockHash), a.Signature)
+}
+
+// Encode the approval for gossip
+func (a *Approval) Encode() []byte {
+	enc := NewEncoder()
+	a.encode(enc)
+	return enc.Bytes()
+}
+
+func (a *Approval) encode(enc *Encoder) {
+	enc.WriteString(a.Verifier)
+	enc.WriteBytes(a.BlockHash)
+	enc.WriteBytes(a.Signature)
+}
+
+// Decode an approval encoded with Encode
+func DecodeApproval(data []byte) (*Approval, error) {
+	dec := NewDecoder(data)
+	approval := decodeApproval(dec)
+	if err := dec.Finish(); err != nil {
+		return nil, err
+	}
+
+	return approval, nil
+}
+
+func decodeApproval(dec *Decoder) *Approval {
+	return &Approval{
+		Verifier:  dec.ReadString(),
+		BlockHash: dec.ReadBytes(),
+		Signature: dec.ReadBytes(),
+	}
+}
+
+// QuorumCertificate is the proof that a block was approved by the elected verifiers
+type QuorumCertificate struct {
+	BlockHash []byte     `json:"blockhash"`
+	Approvals []Approval `json:"approvals"`
+}
+
+func NewQuorumCertificate(blockHash []byte, approvals []Approval) *QuorumCertificate {
+	return &QuorumCertificate{
+		BlockHash: blockHash,
+		Approvals: approvals,
+	}
+}
+
+func (qc *QuorumCertificate) encode(enc *Encoder) {
+	enc.WriteBytes(qc.BlockHash)
+	enc.WriteUint(uint64(len(qc.Approvals)))
+	for _, approval := range qc.Approvals {
+		approval.encode(enc)
+	}
+}
+
+func decodeQuorumCertificate(dec *Decoder) *QuorumCertificate {
+	qc := &QuorumCertificate{
+		BlockHash: dec.ReadBytes(),
+		Approvals: []Approval{},
+	}
+
+	count := dec.ReadUint()
+	for i := uint64(0); i < count && dec.Err() == nil; i++ {
+		qc.Approvals = append(qc.Approvals, *decodeApproval(dec))
+	}
+
+	return qc
+}
+
+// Share of the weight of the verifiers which must be exceeded by the approvals of a block
+type Threshold struct {
+	Numerator   uint64 `json:"numerator"`
+	Denominator uint64 `json:"denominator"`
+}
+
+// Threshold which tolerates less than a third of faulty verifiers
+func DefaultThreshold() Threshold {
+	return Threshold{Numerator: 2, Denominator: 3}
+}
+
+// Parse a threshold written as a fraction such as 2/3
+func ParseThreshold(value string) (Threshold, error) {
+	var threshold Threshold
+	if _, err := fmt.Sscanf(value, "%d/%d", &threshold.Numerator, &threshold.Denominator); err != nil {
+		return Threshold{}, fmt.Errorf("invalid threshold %q: %w", value, err)
+	}
+	if threshold.Denominator == 0 || threshold.Numerator >= threshold.Denominator {
+		return Threshold{}, fmt.Errorf("threshold %q must be a fraction below 1", value)
+	}
+
+	return threshold, nil
+}
+
+// Verifiers which approve the blocks and the weight of their approvals
+type Quorum struct {
+	Verifiers []string
+	// Weight of the approval of every verifier, every approval counts once if nil
+	Weights   map[string]uint64
+	Threshold Threshold
+}
+
+func (q *Quorum) IsVerifier(id string) bool {
+	for _, v := range q.Verifiers {
+		if v == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *Quorum) weight(id string) uint64 {
+	if q.Weights == nil {
+		return 1
+	}
+
+	return q.Weights[id]
+}
+
+// Check if the approvals of the distinct verifiers exceed the threshold of the weight of all the verifiers.
+// The weights are summed without overflow as the stakes can be as large as any uint64.
+func (q *Quorum) Reached(approvers map[string]bool) bool {
+	total, approved := new(big.Int), new(big.Int)
+	for _, v := range q.Verifiers {
+		weight := new(big.Int).SetUint64(q.weight(v))
+		total.Add(total, weight)
+		if approvers[v] {
+			approved.Add(approved, weight)
+		}
+	}
+	if total.Sign() == 0 {
+		return false
+	}
+
+	approved.Mul(approved, new(big.Int).SetUint64(q.Threshold.Denominator))
+	total.Mul(total, new(big.Int).SetUint64(q.Threshold.Numerator))
+	return approved.Cmp(total) > 0
+}
+
+// Verify that the certificate approves the block hash with valid signatures from distinct registered nodes.
+// This does not need the verifiers of the block, so it can be checked before the state of its branch is known.
+func (qc *QuorumCertificate) VerifySignatures(blockHash []byte, pubKeyMap map[string]ecdsa.PublicKey) bool {
+	if !bytes.Equal(qc.BlockHash, blockHash) {
+		return false
+	}
+
+	approved := make(map[string]bool)
+	for _, approval := range qc.Approvals {
+		if approved[approval.Verifier] {
+			return false
+		}
+
+		pubKey, ok := pubKeyMap[approval.Verifier]
+		if !ok || !bytes.Equal(approval.BlockHash, blockHash) || !approval.Verify(pubKey) {
+			return false
+		}
+
+		approved[approval.Verifier] = true
+	}
+
+	return true
+}
+
+// Verify that the certificate approves the block hash with valid signatures
+// from distinct verifiers of the quorum whose approvals reach the threshold
+func (qc *QuorumCertificate) Verify(blockHash []byte, quorum *Quorum, pubKeyMap map[string]ecdsa.PublicKey) bool {
+	approved := make(map[string]bool)
+	for _, approval := range qc.Approvals {
+		if !quorum.IsVerifier(approval.Verifier) {
+			return false
+		}
+		approved[approval.Verifier] = true
+	}
+
+	return qc.VerifySignatures(blockHash, pubKeyMap) && quorum.Reached(approved)
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"math"
+	"testing"
+)
+
+func TestQuorumCountsEveryVerifierOnce(t *testing.T) {
+	quorum := Quorum{Verifiers: []string{"a", "b", "c", "d"}, Threshold: DefaultThreshold()}
+
+	if quorum.Reached(map[string]bool{"a": true, "b": true}) {
+		t.Error("two of four verifiers reached a two thirds quorum")
+	}
+	if !quorum.Reached(map[string]bool{"a": true, "b": true, "c": true}) {
+		t.Error("three of four verifiers did not reach a two thirds quorum")
+	}
+	if quorum.Reached(map[string]bool{"a": true, "b": true, "x": true, "y": true}) {
+		t.Error("approvals of nodes which are not verifiers were counted")
+	}
+}
+
+func TestDefaultVerifiersTolerateAnOfflineVerifier(t *testing.T) {
+	election := DefaultElection()
+	verifiers := []string{"a", "b", "c", "d", "e", "f"}[:election.Verifiers]
+	quorum := Quorum{Verifiers: verifiers, Threshold: election.Threshold}
+
+	online := make(map[string]bool)
+	for _, v := range verifiers[1:] {
+		online[v] = true
+	}
+	if !quorum.Reached(online) {
+		t.Errorf("an offline verifier out of %d stops the blocks", election.Verifiers)
+	}
+}
+
+func TestQuorumWeighsTheApprovals(t *testing.T) {
+	quorum := Quorum{
+		Verifiers: []string{"a", "b", "c"},
+		Weights:   map[string]uint64{"a": 10, "b": 1, "c": 1},
+		Threshold: DefaultThreshold(),
+	}
+
+	if !quorum.Reached(map[string]bool{"a": true}) {
+		t.Error("the verifier with most of the weight did not reach the quorum")
+	}
+	if quorum.Reached(map[string]bool{"b": true, "c": true}) {
+		t.Error("the verifiers with little weight reached the quorum")
+	}
+
+	// Verifiers without weight never reach a quorum
+	empty := Quorum{Verifiers: []string{"a"}, Weights: map[string]uint64{}, Threshold: DefaultThreshold()}
+	if empty.Reached(map[string]bool{"a": true}) {
+		t.Error("a quorum without weight was reached")
+	}
+	if (&Quorum{Threshold: DefaultThreshold()}).Reached(map[string]bool{}) {
+		t.Error("a quorum without verifiers was reached")
+	}
+}
+
+func TestQuorumWeightsDoNotOverflow(t *testing.T) {
+	quorum := Quorum{
+		Verifiers: []string{"a", "b", "c"},
+		Weights:   map[string]uint64{"a": math.MaxUint64, "b": math.MaxUint64, "c": 1},
+		Threshold: DefaultThreshold(),
+	}
+
+	if quorum.Reached(map[string]bool{"a": true}) {
+		t.Error("half of the weight reached a two thirds quorum")
+	}
+	if !quorum.Reached(map[string]bool{"a": true, "b": true}) {
+		t.Error("almost all of the weight did not reach a two thirds quorum")
+	}
+}
+
+func TestCertificateCountsEveryVerifierOnce(t *testing.T) {
+	keys := make(map[string]*ecdsa.PrivateKey)
+	pubKeys := make(map[string]ecdsa.PublicKey)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		keys[id] = newTestKey(t)
+		pubKeys[id] = keys[id].PublicKey
+	}
+	quorum := &Quorum{Verifiers: []string{"a", "b", "c", "d"}, Threshold: DefaultThreshold()}
+	blockHash := []byte("block")
+
+	approve := func(id string) Approval {
+		signature, err := ecdsa.SignASN1(rand.Reader, keys[id], ApprovalDigest(blockHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Approval{Verifier: id, BlockHash: blockHash, Signature: signature}
+	}
+
+	if !NewQuorumCertificate(blockHash, []Approval{approve("a"), approve("b"), approve("c")}).Verify(blockHash, quorum, pubKeys) {
+		t.Error("certificate of three of four verifiers does not verify")
+	}
+	if NewQuorumCertificate(blockHash, []Approval{approve("a"), approve("b"), approve("b")}).Verify(blockHash, quorum, pubKeys) {
+		t.Error("certificate with a duplicate approval verifies")
+	}
+	if NewQuorumCertificate(blockHash, []Approval{approve("a"), approve("b"), approve("c")}).Verify([]byte("other"), quorum, pubKeys) {
+		t.Error("certificate verifies for another block")
+	}
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// Number of blocks of an epoch if the election does not define it
+	DefaultEpochLength uint = 10
+	// Number of verifiers elected for an epoch if the election does not define it, the smallest
+	// number of verifiers of which one can be offline without stopping the blocks at a 2/3 threshold
+	DefaultVerifierCount = 4
+)
+
+var ErrInvalidVote = errors.New("stake and vote transactions can not move products and must name distinct candidates")
+
+// Rules of the election of the verifiers. Every node of a chain must use the same election.
+type Election struct {
+	// Number of blocks of an epoch. The verifiers elected at the end of an epoch propose
+	// and approve the blocks of the next epoch
+	EpochLength uint `json:"epochlength"`
+	// Number of verifiers elected for an epoch
+	Verifiers int `json:"verifiers"`
+	// Share of the verifiers whose approvals commit a block
+	Threshold Threshold `json:"threshold"`
+	// Weigh the approvals of the verifiers by their stake instead of counting every verifier once
+	WeighByStake bool `json:"weighbystake"`
+	// Verifiers of the blocks until the first epoch ends
+	Bootstrap []string `json:"bootstrap"`
+}
+
+func DefaultElection() Election {
+	return Election{
+		EpochLength: DefaultEpochLength,
+		Verifiers:   DefaultVerifierCount,
+		Threshold:   DefaultThreshold(),
+	}
+}
+
+// Stake of the nodes which voted for a candidate
+type CandidateTally struct {
+	Candidate string `json:"candidate"`
+	Votes     uint64 `json:"votes"`
+}
+
+// Check that a stake or vote transaction can be added to a block of the given version
+func checkElectionTransaction(version uint32, tx *Transaction) error {
+	if !HasRule(version, RuleElections) {
+		return ErrInvalidKind
+	}
+	if tx.ProductID != "" || len(tx.Products) > 0 {
+		return fmt.Errorf("%s: %w", tx.Sender, ErrInvalidVote)
+	}
+	if tx.Kind != Vote {
+		return nil
+	}
+
+	if tx.Version < TransactionVersion7 {
+		if tx.Receiver == "" {
+			return fmt.Errorf("%s voted for no candidate: %w", tx.Sender, ErrInvalidVote)
+		}
+		return nil
+	}
+	if !HasRule(version, RuleCandidateLists) {
+		return ErrInvalidKind
+	}
+
+	seen := make(map[string]bool)
+	for _, candidate := range tx.Candidates {
+		if candidate == "" || seen[candidate] {
+			return fmt.Errorf("%s voted for candidate %q: %w", tx.Sender, candidate, ErrInvalidVote)
+		}
+		seen[candidate] = true
+	}
+
+	return nil
+}
+
+func (s *State) applyElectionTransaction(tx *Transaction) {
+	switch tx.Kind {
+	case Stake:
+		s.Stakes[tx.Sender] = tx.Amount
+	case Vote:
+		candidates := tx.VotedCandidates()
+		if len(candidates) == 0 {
+			delete(s.Votes, tx.Sender)
+			return
+		}
+		s.Votes[tx.Sender] = append([]string{}, candidates...)
+	}
+}
+
+// Elect the verifiers of the next epoch if the block at the given height is the last block of an epoch.
+// The verifiers of the last epoch are kept if no candidate received any votes.
+func (s *State) endEpoch(height uint) {
+	if s.Election.EpochLength == 0 || height%s.Election.EpochLength != 0 {
+		return
+	}
+
+	s.Epoch = height / s.Election.EpochLength
+	if verifiers := electVerifiers(s.tally(), s.Election.Verifiers); len(verifiers) > 0 {
+		s.Verifiers = verifiers
+	}
+}
+
+// Count the stake of the voters of every candidate which has a stake itself. The complete stake
+// of a voter is delegated to every candidate it votes for and the votes of a candidate are capped
+// at the maximum uint64. The candidates are ordered by their votes and then by their ID so that
+// every node computes the same tally.
+func (s *State) tally() []CandidateTally {
+	votes := make(map[string]uint64)
+	for voter, candidates := range s.Votes {
+		for _, candidate := range candidates {
+			if s.Stakes[candidate] > 0 {
+				votes[candidate] = addStake(votes[candidate], s.Stakes[voter])
+			}
+		}
+	}
+
+	tally := make([]CandidateTally, 0, len(votes))
+	for candidate, count := range votes {
+		tally = append(tally, CandidateTally{Candidate: candidate, Votes: count})
+	}
+	sort.Slice(tally, func(i, j int) bool {
+		if tally[i].Votes != tally[j].Votes {
+			return tally[i].Votes > tally[j].Votes
+		}
+		return tally[i].Candidate < tally[j].Candidate
+	})
+
+	return tally
+}
+
+// Add two stakes, a sum that does not fit a uint64 is capped at its maximum
+func addStake(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+
+	return a + b
+}
+
+// Get the candidates with the most votes, candidates without votes are never elected
+func electVerifiers(tally []CandidateTally, count int) []string {
+	verifiers := make([]string, 0, count)
+	for _, candidate := range tally {
+		if len(verifiers) == count || candidate.Votes == 0 {
+			break
+		}
+		verifiers = append(verifiers, candidate.Candidate)
+	}
+
+	return verifiers
+}
+
+// Get the amount staked by the node
+func (s *State) Stake(id string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Stakes[id]
+}
+
+// Get the current tally of the votes for every candidate
+func (s *State) Tally() []CandidateTally {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tally()
+}
+
+// Get the verifiers elected at the end of the last epoch, which are the bootstrap verifiers until the first epoch ends
+func (s *State) ElectedVerifiers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.Verifiers...)
+}
+
+// Get the number of epochs that ended
+func (s *State) CurrentEpoch() uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Epoch
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Create a chain whose epochs end every 3 blocks and elect 2 verifiers
+func newElectionChain(t *testing.T, bootstrap ...string) *testChain {
+	t.Helper()
+
+	election := Election{EpochLength: 3, Verifiers: 2, Threshold: DefaultThreshold(), Bootstrap: bootstrap}
+	state := NewState("test", DefaultLifecycle(), election)
+	state.Apply(CreateGenesisBlock())
+
+	return &testChain{t: t, state: state, roles: make(map[string]string), nonces: make(map[string]uint64)}
+}
+
+func TestBootstrapVerifiersUntilTheFirstEpochEnds(t *testing.T) {
+	c := newElectionChain(t, "a", "b")
+	if verifiers := c.state.ElectedVerifiers(); !reflect.DeepEqual(verifiers, []string{"a", "b"}) {
+		t.Fatalf("verifiers before the first epoch are %v", verifiers)
+	}
+
+	// The bootstrap verifiers are kept if nobody voted
+	c.apply()
+	c.apply()
+	c.apply()
+	if epoch, verifiers := c.state.CurrentEpoch(), c.state.ElectedVerifiers(); epoch != 1 || !reflect.DeepEqual(verifiers, []string{"a", "b"}) {
+		t.Fatalf("verifiers of epoch %d without votes are %v", epoch, verifiers)
+	}
+
+	c.apply(NewStakeTransaction("x", 5, c.next("x"), "test"), NewStakeTransaction("y", 3, c.next("y"), "test"))
+	c.apply(NewVoteTransaction("x", []string{"x", "y"}, c.next("x"), "test"))
+	c.apply()
+	if verifiers := c.state.ElectedVerifiers(); !reflect.DeepEqual(verifiers, []string{"x", "y"}) {
+		t.Fatalf("elected verifiers are %v", verifiers)
+	}
+}
+
+func TestTallyDoesNotOverflow(t *testing.T) {
+	c := newElectionChain(t, "a")
+	c.apply(
+		NewStakeTransaction("x", math.MaxUint64, c.next("x"), "test"),
+		NewStakeTransaction("y", math.MaxUint64, c.next("y"), "test"),
+		NewStakeTransaction("z", 1, c.next("z"), "test"),
+	)
+	c.apply(
+		NewVoteTransaction("x", []string{"z"}, c.next("x"), "test"),
+		NewVoteTransaction("y", []string{"z"}, c.next("y"), "test"),
+	)
+
+	if tally := c.state.Tally(); len(tally) != 1 || tally[0].Votes != math.MaxUint64 {
+		t.Errorf("tally of two maximum stakes is %+v", tally)
+	}
+}
+
+func TestTallyDelegatesTheStakeOfTheVoters(t *testing.T) {
+	c := newElectionChain(t, "a")
+	c.apply(
+		NewStakeTransaction("x", 5, c.next("x"), "test"),
+		NewStakeTransaction("y", 3, c.next("y"), "test"),
+		NewStakeTransaction("z", 3, c.next("z"), "test"),
+		NewStakeTransaction("w", 7, c.next("w"), "test"),
+	)
+	// The stake of w is delegated in full to both candidates, and u without a stake is never a candidate
+	c.apply(
+		NewVoteTransaction("w", []string{"y", "z", "u"}, c.next("w"), "test"),
+		NewVoteTransaction("x", []string{"x"}, c.next("x"), "test"),
+	)
+
+	expected := []CandidateTally{{Candidate: "y", Votes: 7}, {Candidate: "z", Votes: 7}, {Candidate: "x", Votes: 5}}
+	if tally := c.state.Tally(); !reflect.DeepEqual(tally, expected) {
+		t.Errorf("tally is %+v", tally)
+	}
+	if verifiers := electVerifiers(c.state.Tally(), 2); !reflect.DeepEqual(verifiers, []string{"y", "z"}) {
+		t.Errorf("elected verifiers are %v", verifiers)
+	}
+
+	// A withdrawn vote and a withdrawn stake are no longer counted
+	c.apply(
+		NewVoteTransaction("w", nil, c.next("w"), "test"),
+		NewStakeTransaction("x", 0, c.next("x"), "test"),
+	)
+	if tally := c.state.Tally(); len(tally) != 0 {
+		t.Errorf("tally after the withdrawals is %+v", tally)
+	}
+}
+
+func TestElectionTransactions(t *testing.T) {
+	c := newElectionChain(t, "a")
+
+	if err := c.check(versionBefore(RuleElections), NewStakeTransaction("x", 1, c.next("x"), "test")); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("stake before version 12 returned %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, NewVoteTransaction("x", []string{"y", "y"}, c.next("x"), "test")); !errors.Is(err, ErrInvalidVote) {
+		t.Errorf("vote for a duplicate candidate returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleCandidateLists), NewVoteTransaction("x", []string{"y", "z"}, c.next("x"), "test")); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("vote for many candidates before version 15 returned %v", err)
+	}
+
+	stake := NewStakeTransaction("x", 1, c.next("x"), "test")
+	stake.ProductID = "p"
+	if err := c.check(CurrentBlockVersion, stake); !errors.Is(err, ErrInvalidVote) {
+		t.Errorf("stake that moves a product returned %v", err)
+	}
+}
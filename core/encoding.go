@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrUnexpectedEnd = errors.New("unexpected end of encoded data")
+	ErrTrailingData  = errors.New("trailing data after encoded value")
+	ErrInvalidBool   = errors.New("boolean is not encoded as 0 or 1")
+)
+
+// Encoder writes values in the canonical binary encoding used for hashing, signing and gossip.
+// Integers are written as 8 byte big endian values and byte strings are prefixed
+// with their length as a 4 byte big endian value, so the encoding of a sequence
+// of values is never ambiguous.
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+func (e *Encoder) WriteUint(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) WriteInt(v int64) {
+	e.WriteUint(uint64(v))
+}
+
+func (e *Encoder) WriteBool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *Encoder) WriteBytes(v []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(v)))
+	e.buf.Write(b[:])
+	e.buf.Write(v)
+}
+
+func (e *Encoder) WriteString(v string) {
+	e.WriteBytes([]byte(v))
+}
+
+// Write the number of strings followed by the strings
+func (e *Encoder) WriteStrings(v []string) {
+	e.WriteUint(uint64(len(v)))
+	for _, s := range v {
+		e.WriteString(s)
+	}
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// Decoder reads values written by an Encoder.
+// The first error is remembered and all the following reads return zero values,
+// so the error only needs to be checked once after all the values are read.
+type Decoder struct {
+	data []byte
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = ErrUnexpectedEnd
+		return nil
+	}
+
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *Decoder) ReadUint() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *Decoder) ReadInt() int64 {
+	return int64(d.ReadUint())
+}
+
+// Read a boolean, which must be encoded as 0 or 1 so that every value has a single encoding
+func (d *Decoder) ReadBool() bool {
+	b := d.next(1)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		d.err = ErrInvalidBool
+		return false
+	}
+
+	return b[0] == 1
+}
+
+func (d *Decoder) ReadBytes() []byte {
+	b := d.next(4)
+	if b == nil {
+		return nil
+	}
+
+	v := d.next(int(binary.BigEndian.Uint32(b)))
+	if v == nil {
+		return nil
+	}
+
+	return append([]byte{}, v...)
+}
+
+func (d *Decoder) ReadString() string {
+	return string(d.ReadBytes())
+}
+
+func (d *Decoder) ReadStrings() []string {
+	n := d.ReadUint()
+
+	var v []string
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		v = append(v, d.ReadString())
+	}
+
+	return v
+}
+
+// Get the first error that occurred while decoding
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Check that all the data was decoded without errors
+func (d *Decoder) Finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return ErrTrailingData
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testTransactions() []*Transaction {
+	transfer := NewTransaction(Transfer, "m", "d", "p1", Manufactured, 1, "test")
+	lot := NewLotTransaction(Offer, "m", "d", "lot", []string{"p2", "p3"}, Dispatched, 2, "test")
+	stake := NewStakeTransaction("m", 25, 3, "test")
+	vote := NewVoteTransaction("m", []string{"a", "b"}, 4, "test")
+	register := NewRegisterTransaction("m", "manufacturer", 5, "test")
+
+	// Transactions of the older versions
+	legacy := &Transaction{Version: TransactionVersion1, Sender: "m", Receiver: "d", ProductID: "p4", Status: Manufactured}
+	legacy.ID = legacy.Hash()
+	v4 := &Transaction{Version: TransactionVersion4, Kind: Accept, Sender: "d", Receiver: "m", ProductID: "p5", Status: Dispatched, Nonce: 5, Timestamp: 10, ChainID: "test", OfferID: []byte{1, 2}}
+	v4.ID = v4.Hash()
+
+	txs := []*Transaction{transfer, lot, stake, vote, register, legacy, v4}
+	for i, tx := range txs {
+		tx.Signature = []byte{byte(i), 0xaa}
+	}
+	return txs
+}
+
+func TestTransactionEncodingRoundTrip(t *testing.T) {
+	for _, tx := range testTransactions() {
+		decoded, err := DecodeTransaction(tx.Encode())
+		if err != nil {
+			t.Fatalf("decoding transaction of version %d: %s", tx.Version, err)
+		}
+
+		if !bytes.Equal(decoded.Encode(), tx.Encode()) {
+			t.Errorf("transaction of version %d changed after a round trip", tx.Version)
+		}
+		if !bytes.Equal(decoded.Hash(), tx.ID) || !bytes.Equal(decoded.Signature, tx.Signature) {
+			t.Errorf("transaction of version %d has a different ID or signature after a round trip", tx.Version)
+		}
+	}
+}
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	block := NewBlock(testTransactions(), []byte("prev"), 7, 3, "v")
+	block.Signature = []byte("signature")
+	block.Certificate = NewQuorumCertificate(block.Hash, []Approval{
+		{Verifier: "a", BlockHash: block.Hash, Signature: []byte("a")},
+		{Verifier: "b", BlockHash: block.Hash, Signature: []byte("b")},
+	})
+
+	blocks, err := DecodeBlocks(EncodeBlocks([]*Block{block, CreateGenesisBlock()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("decoded %d blocks, want 2", len(blocks))
+	}
+
+	decoded := blocks[0]
+	if !bytes.Equal(decoded.Encode(), block.Encode()) {
+		t.Error("block changed after a round trip")
+	}
+	if !bytes.Equal(decoded.ComputeHash(), block.Hash) || decoded.View != block.View {
+		t.Error("block has a different hash or view after a round trip")
+	}
+	if decoded.Approvals() != 2 {
+		t.Errorf("block has %d approvals after a round trip, want 2", decoded.Approvals())
+	}
+	if !bytes.Equal(blocks[1].ComputeHash(), CreateGenesisBlock().Hash) {
+		t.Error("genesis block has a different hash after a round trip")
+	}
+}
+
+func TestViewIsOnlyEncodedFromVersion14(t *testing.T) {
+	block := NewBlock([]*Transaction{}, []byte("prev"), 2, 5, "v")
+	block.Version = versionBefore(RuleViewChanges)
+
+	decoded, err := DecodeBlock(block.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.View != 0 {
+		t.Errorf("view of a version 13 block is %d after a round trip, want 0", decoded.View)
+	}
+}
+
+func TestDecodeRejectsMalformedData(t *testing.T) {
+	encoded := testTransactions()[0].Encode()
+
+	if _, err := DecodeTransaction(encoded[:len(encoded)-1]); !errors.Is(err, ErrUnexpectedEnd) {
+		t.Errorf("decoding a truncated transaction returned %v", err)
+	}
+	if _, err := DecodeTransaction(append(encoded, 0)); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("decoding a transaction with trailing data returned %v", err)
+	}
+
+	block := NewBlock(testTransactions(), []byte("prev"), 2, 0, "v").Encode()
+	if _, err := DecodeBlock(block[:len(block)/2]); err == nil {
+		t.Error("decoding a truncated block succeeded")
+	}
+
+	// The last byte of a block without a certificate is the boolean which marks the certificate as absent
+	block[len(block)-1] = 2
+	if _, err := DecodeBlock(block); !errors.Is(err, ErrInvalidBool) {
+		t.Errorf("decoding a boolean other than 0 or 1 returned %v", err)
+	}
+}
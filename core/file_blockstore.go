@@ -0,0 +1,277 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Animesh-03/scms/logger"
+)
+
+// Size of the record header: payload length followed by the CRC32 of the payload
+const recordHeaderSize = 8
+
+// FileBlockStore is an append only, file backed BlockStore.
+// Every block is written as a record of the form [length][crc32][encoded block]
+// and the file is synced after every append so a crash can at most leave
+// a partially written record at the tail, which is discarded on startup.
+type FileBlockStore struct {
+	mu     sync.RWMutex
+	file   *os.File
+	blocks []*Block
+	hashes map[string]int
+	// Offset of the record of every block in the file
+	offsets []int64
+	size    int64
+}
+
+// Open the block store at the given path, creating it if it does not exist,
+// and load all the blocks stored in it
+func OpenFileBlockStore(path string) (*FileBlockStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileBlockStore{
+		file:   file,
+		blocks: make([]*Block, 0),
+		hashes: make(map[string]int),
+	}
+
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Read all the records from the file and truncate any partially written tail
+func (s *FileBlockStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	offset := int64(0)
+	for offset < size {
+		block, n, err := readRecord(s.file, size-offset)
+		if err == nil && !s.extendsTip(block) {
+			err = ErrBlockNotOnTip
+		}
+		if err != nil {
+			logger.LogWarn("Recovering block store %s: discarding %d bytes at offset %d: %s\n", s.file.Name(), size-offset, offset, err)
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := s.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+
+		s.index(block, offset)
+		offset += n
+	}
+
+	s.size = offset
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Read a single record from the reader and return the block and the number of bytes read.
+// The record can not be longer than the remaining bytes of the file, so a corrupt length is never allocated.
+func readRecord(r io.Reader, remaining int64) (*Block, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:])
+	if int64(length) > remaining-recordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	// Blocks written before the binary encoding was introduced are stored as JSON
+	if len(payload) > 0 && payload[0] == '{' {
+		var block Block
+		if err := json.Unmarshal(payload, &block); err != nil {
+			return nil, 0, err
+		}
+
+		return &block, int64(recordHeaderSize + length), nil
+	}
+
+	block, err := DecodeBlock(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return block, int64(recordHeaderSize + length), nil
+}
+
+// Check if the block can be appended to the current tip
+func (s *FileBlockStore) extendsTip(block *Block) bool {
+	if len(s.blocks) == 0 {
+		return true
+	}
+
+	tip := s.blocks[len(s.blocks)-1]
+	return block.Height == tip.Height+1 && bytes.Equal(block.PreviousBlockHash, tip.Hash)
+}
+
+func (s *FileBlockStore) index(block *Block, offset int64) {
+	s.hashes[string(block.Hash)] = len(s.blocks)
+	s.blocks = append(s.blocks, block)
+	s.offsets = append(s.offsets, offset)
+}
+
+func (s *FileBlockStore) Append(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.extendsTip(block) {
+		return ErrBlockNotOnTip
+	}
+
+	payload := block.Encode()
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	if _, err := s.file.Write(record); err != nil {
+		return s.discardTail(err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return s.discardTail(err)
+	}
+
+	s.index(block, s.size)
+	s.size += int64(len(record))
+	return nil
+}
+
+// Cut a partially written record off the file so that the next record is appended after the tip
+func (s *FileBlockStore) discardTail(err error) error {
+	if truncateErr := s.file.Truncate(s.size); truncateErr != nil {
+		logger.LogError("Error discarding the tail of block store %s: %s\n", s.file.Name(), truncateErr)
+	} else if _, seekErr := s.file.Seek(s.size, io.SeekStart); seekErr != nil {
+		logger.LogError("Error discarding the tail of block store %s: %s\n", s.file.Name(), seekErr)
+	}
+
+	return err
+}
+
+func (s *FileBlockStore) GetByHeight(height uint) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.blocks) == 0 {
+		return nil, ErrBlockStoreEmpty
+	}
+
+	first := s.blocks[0].Height
+	if height < first || height-first >= uint(len(s.blocks)) {
+		return nil, ErrBlockNotFound
+	}
+
+	return s.blocks[height-first], nil
+}
+
+func (s *FileBlockStore) GetByHash(hash []byte) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.hashes[string(hash)]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+
+	return s.blocks[i], nil
+}
+
+func (s *FileBlockStore) Tip() *Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.blocks) == 0 {
+		return nil
+	}
+
+	return s.blocks[len(s.blocks)-1]
+}
+
+func (s *FileBlockStore) Truncate(height uint) ([]*Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.blocks) == 0 {
+		return nil, ErrBlockStoreEmpty
+	}
+
+	first := s.blocks[0].Height
+	if height < first {
+		return nil, ErrBlockNotFound
+	}
+
+	keep := height - first + 1
+	if keep >= uint(len(s.blocks)) {
+		return []*Block{}, nil
+	}
+
+	offset := s.offsets[keep]
+	if err := s.file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return nil, err
+	}
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	removed := make([]*Block, len(s.blocks[keep:]))
+	copy(removed, s.blocks[keep:])
+	for _, block := range removed {
+		delete(s.hashes, string(block.Hash))
+	}
+
+	s.blocks = s.blocks[:keep]
+	s.offsets = s.offsets[:keep]
+	s.size = offset
+
+	return removed, nil
+}
+
+func (s *FileBlockStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// Marshal the store as the list of blocks in the chain
+func (s *FileBlockStore) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return json.Marshal(s.blocks)
+}
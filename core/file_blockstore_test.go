@@ -0,0 +1,193 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Open a block store in a temporary directory and append the genesis block and the given number of blocks
+func newTestStore(t *testing.T, blocks int) (*FileBlockStore, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "blocks")
+	store, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if err := store.Append(CreateGenesisBlock()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < blocks; i++ {
+		appendTestBlock(t, store)
+	}
+
+	return store, path
+}
+
+func appendTestBlock(t *testing.T, store *FileBlockStore) *Block {
+	t.Helper()
+
+	tip := store.Tip()
+	block := NewBlock([]*Transaction{}, tip.Hash, tip.Height+1, 0, "v")
+	if err := store.Append(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func reopenTestStore(t *testing.T, store *FileBlockStore, path string) *FileBlockStore {
+	t.Helper()
+
+	store.Close()
+	reopened, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+
+	return reopened
+}
+
+// Write the bytes at the end of the file as if a record was partially written
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockStoreKeepsTheBlocksAcrossRestarts(t *testing.T) {
+	store, path := newTestStore(t, 2)
+	tip := store.Tip()
+
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 3 {
+		t.Fatalf("tip after restart is at height %d", store.Tip().Height)
+	}
+	if block, err := store.GetByHash(tip.Hash); err != nil || block.Height != tip.Height {
+		t.Errorf("tip is not found by its hash: %v", err)
+	}
+	if block, err := store.GetByHeight(2); err != nil || block.Height != 2 {
+		t.Errorf("block at height 2 is not found: %v", err)
+	}
+}
+
+func TestBlockStoreDiscardsATornTail(t *testing.T) {
+	store, path := newTestStore(t, 2)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, 100)
+	appendToFile(t, path, append(header, 1, 2, 3))
+
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 3 {
+		t.Fatalf("tip after recovery is at height %d", store.Tip().Height)
+	}
+	if recovered, err := os.Stat(path); err != nil || recovered.Size() != info.Size() {
+		t.Fatalf("torn tail was not cut off the file")
+	}
+
+	// Blocks appended after the recovery are kept
+	appendTestBlock(t, store)
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 4 {
+		t.Errorf("tip after appending to the recovered store is at height %d", store.Tip().Height)
+	}
+}
+
+func TestBlockStoreDiscardsACorruptRecord(t *testing.T) {
+	store, path := newTestStore(t, 2)
+	offset := store.offsets[2]
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset+recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 2 {
+		t.Errorf("tip after a corrupt checksum is at height %d", store.Tip().Height)
+	}
+}
+
+func TestBlockStoreRejectsAHugeRecordLength(t *testing.T) {
+	store, path := newTestStore(t, 1)
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, 0xfffffff0)
+	appendToFile(t, path, header)
+
+	if _, _, err := readRecord(bytes.NewReader(header), int64(len(header))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("record longer than the file returned %v", err)
+	}
+
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 2 {
+		t.Errorf("tip after a huge record length is at height %d", store.Tip().Height)
+	}
+}
+
+func TestBlockStoreTruncate(t *testing.T) {
+	store, path := newTestStore(t, 3)
+
+	removed, err := store.Truncate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0].Height != 3 || removed[1].Height != 4 {
+		t.Fatalf("truncate removed %d blocks", len(removed))
+	}
+	if _, err := store.GetByHash(removed[0].Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("removed block is still found: %v", err)
+	}
+	if _, err := store.Truncate(0); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("truncating below the first block returned %v", err)
+	}
+
+	block := appendTestBlock(t, store)
+	store = reopenTestStore(t, store, path)
+	if tip := store.Tip(); tip.Height != 3 || string(tip.Hash) != string(block.Hash) {
+		t.Errorf("tip after truncating and appending is at height %d", tip.Height)
+	}
+}
+
+func TestBlockStoreDiscardsAFailedAppend(t *testing.T) {
+	store, path := newTestStore(t, 1)
+
+	// A record of which only a part was written before the write failed
+	if _, err := store.file.Write([]byte{0, 0, 0, 9, 1}); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("write failed")
+	if err := store.discardTail(failed); err != failed {
+		t.Fatalf("discarding the tail returned %v", err)
+	}
+
+	appendTestBlock(t, store)
+	store = reopenTestStore(t, store, path)
+	if store.Tip().Height != 3 {
+		t.Errorf("tip after a failed append is at height %d", store.Tip().Height)
+	}
+}
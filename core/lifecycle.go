@@ -0,0 +1,254 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Status of a product before its first transaction
+const StatusNone TransactionStatus = 0
+
+// Number of blocks after which an offer expires if the lifecycle does not define it
+const DefaultOfferExpiry uint = 10
+
+var (
+	ErrInvalidTransition = errors.New("transition is not allowed by the lifecycle")
+	ErrRoleNotAllowed    = errors.New("role is not allowed to perform the transition")
+)
+
+// State in the lifecycle of a product
+type LifecycleState struct {
+	ID   TransactionStatus `json:"id"`
+	Name string            `json:"name"`
+	// The product has been delivered to the consumer
+	Delivered bool `json:"delivered,omitempty"`
+	// The product is being returned by the consumer
+	Return bool `json:"return,omitempty"`
+	// The return of the product has been received and the consumer is owed a refund, which implies Return
+	Refund bool `json:"refund,omitempty"`
+}
+
+// Transition of a product between two states of the lifecycle.
+// A transition with an empty From creates the product.
+type LifecycleTransition struct {
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Roles []string `json:"roles"`
+	// The receiver of the transaction becomes the holder of the product, otherwise the sender keeps it
+	TransfersCustody bool `json:"transferscustody"`
+}
+
+// Lifecycle defines the states a product can be in, the allowed transitions
+// between them and the roles which may perform each transition.
+// Every node of a chain must use the same lifecycle.
+type Lifecycle struct {
+	Roles       []string              `json:"roles"`
+	States      []LifecycleState      `json:"states"`
+	Transitions []LifecycleTransition `json:"transitions"`
+	// Number of blocks after the block of an offer in which the offer can be accepted
+	OfferExpiry uint `json:"offerexpiry"`
+
+	statuses    map[string]TransactionStatus
+	states      map[TransactionStatus]*LifecycleState
+	transitions map[[2]TransactionStatus]*LifecycleTransition
+}
+
+// Lifecycle of a product that is manufactured, dispatched by any number of distributors and received by a consumer.
+// The consumer can return the product, which is then shipped back to a distributor or the manufacturer.
+func DefaultLifecycle() *Lifecycle {
+	lifecycle := &Lifecycle{
+		Roles: []string{"manufacturer", "distributor", "consumer"},
+		States: []LifecycleState{
+			{ID: Manufactured, Name: "Manufactured"},
+			{ID: Dispatched, Name: "Dispatched"},
+			{ID: Received, Name: "Received", Delivered: true},
+			{ID: ReturnInitiated, Name: "ReturnInitiated", Return: true},
+			{ID: ReturnInTransit, Name: "ReturnInTransit", Return: true},
+			{ID: ReturnReceived, Name: "ReturnReceived", Return: true, Refund: true},
+		},
+		Transitions: []LifecycleTransition{
+			{From: "", To: "Manufactured", Roles: []string{"manufacturer"}, TransfersCustody: true},
+			{From: "Manufactured", To: "Dispatched", Roles: []string{"distributor"}, TransfersCustody: true},
+			{From: "Dispatched", To: "Dispatched", Roles: []string{"distributor"}, TransfersCustody: true},
+			{From: "Dispatched", To: "Received", Roles: []string{"consumer"}, TransfersCustody: false},
+			{From: "Received", To: "ReturnInitiated", Roles: []string{"consumer"}, TransfersCustody: false},
+			{From: "ReturnInitiated", To: "ReturnInTransit", Roles: []string{"consumer"}, TransfersCustody: true},
+			{From: "ReturnInTransit", To: "ReturnInTransit", Roles: []string{"distributor"}, TransfersCustody: true},
+			{From: "ReturnInTransit", To: "ReturnReceived", Roles: []string{"distributor", "manufacturer"}, TransfersCustody: false},
+		},
+	}
+
+	if err := lifecycle.Validate(); err != nil {
+		panic(err)
+	}
+	return lifecycle
+}
+
+// Load the lifecycle from a JSON file
+func LoadLifecycle(path string) (*Lifecycle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lifecycle Lifecycle
+	if err := json.Unmarshal(data, &lifecycle); err != nil {
+		return nil, err
+	}
+
+	if err := lifecycle.Validate(); err != nil {
+		return nil, err
+	}
+	return &lifecycle, nil
+}
+
+// Check that the states, roles and transitions are consistent and index them
+func (l *Lifecycle) Validate() error {
+	if l.OfferExpiry == 0 {
+		l.OfferExpiry = DefaultOfferExpiry
+	}
+
+	roles := make(map[string]bool)
+	for _, role := range l.Roles {
+		if role == "" || roles[role] {
+			return fmt.Errorf("invalid or duplicate role %q", role)
+		}
+		roles[role] = true
+	}
+
+	l.statuses = make(map[string]TransactionStatus)
+	l.states = make(map[TransactionStatus]*LifecycleState)
+	for i := range l.States {
+		state := &l.States[i]
+		if state.ID == StatusNone || state.Name == "" {
+			return fmt.Errorf("state %q must have a name and a non zero id", state.Name)
+		}
+		if _, ok := l.statuses[state.Name]; ok {
+			return fmt.Errorf("duplicate state name %q", state.Name)
+		}
+		if _, ok := l.states[state.ID]; ok {
+			return fmt.Errorf("duplicate state id %d", state.ID)
+		}
+		if state.Refund && !state.Return {
+			return fmt.Errorf("refund state %q must be a return state", state.Name)
+		}
+		l.statuses[state.Name] = state.ID
+		l.states[state.ID] = state
+	}
+
+	l.transitions = make(map[[2]TransactionStatus]*LifecycleTransition)
+	for i := range l.Transitions {
+		transition := &l.Transitions[i]
+
+		from := StatusNone
+		if transition.From != "" {
+			status, ok := l.statuses[transition.From]
+			if !ok {
+				return fmt.Errorf("transition from unknown state %q", transition.From)
+			}
+			from = status
+		}
+		to, ok := l.statuses[transition.To]
+		if !ok {
+			return fmt.Errorf("transition to unknown state %q", transition.To)
+		}
+
+		for _, role := range transition.Roles {
+			if !roles[role] {
+				return fmt.Errorf("transition from %q to %q has unknown role %q", transition.From, transition.To, role)
+			}
+		}
+
+		key := [2]TransactionStatus{from, to}
+		if _, ok := l.transitions[key]; ok {
+			return fmt.Errorf("duplicate transition from %q to %q", transition.From, transition.To)
+		}
+		l.transitions[key] = transition
+	}
+
+	return nil
+}
+
+// Check if the role is defined by the lifecycle
+func (l *Lifecycle) HasRole(role string) bool {
+	for _, r := range l.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the name of the state with the given status, None before the first transaction
+// of the product or an empty string if the status is unknown
+func (l *Lifecycle) StateName(status TransactionStatus) string {
+	if status == StatusNone {
+		return "None"
+	}
+
+	if state, ok := l.states[status]; ok {
+		return state.Name
+	}
+	return ""
+}
+
+// Check if a product with the given status has been delivered to the consumer
+func (l *Lifecycle) IsDelivered(status TransactionStatus) bool {
+	state, ok := l.states[status]
+	return ok && state.Delivered
+}
+
+// Check if a product with the given status is being returned
+func (l *Lifecycle) IsReturn(status TransactionStatus) bool {
+	state, ok := l.states[status]
+	return ok && state.Return
+}
+
+// Check if the return of a product with the given status has been received
+func (l *Lifecycle) IsRefund(status TransactionStatus) bool {
+	state, ok := l.states[status]
+	return ok && state.Refund
+}
+
+// Get the status of the state with the given name
+func (l *Lifecycle) Status(name string) (TransactionStatus, bool) {
+	status, ok := l.statuses[name]
+	return status, ok
+}
+
+// Get the transition between the two states
+func (l *Lifecycle) Transition(from, to TransactionStatus) (*LifecycleTransition, bool) {
+	transition, ok := l.transitions[[2]TransactionStatus{from, to}]
+	return transition, ok
+}
+
+// Check that a node with the given role may move a product between the two states
+func (l *Lifecycle) CanTransition(from, to TransactionStatus, role string) error {
+	transition, ok := l.Transition(from, to)
+	if !ok {
+		return ErrInvalidTransition
+	}
+
+	for _, r := range transition.Roles {
+		if r == role {
+			return nil
+		}
+	}
+
+	return ErrRoleNotAllowed
+}
+
+// Get the states a node with the given role may move a product to from the given state
+func (l *Lifecycle) NextStates(from TransactionStatus, role string) []TransactionStatus {
+	var next []TransactionStatus
+	for _, state := range l.States {
+		if l.CanTransition(from, state.ID, role) == nil {
+			next = append(next, state.ID)
+		}
+	}
+
+	return next
+}
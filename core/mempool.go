@@ -2,9 +2,13 @@ package core
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
 )
 
 type MemPool struct {
+	mu   sync.RWMutex
 	Pool map[string]*Transaction `json:"pool"`
 }
 
@@ -15,36 +19,114 @@ func NewMemPool() *MemPool {
 	return mp
 }
 
+func (mp *MemPool) MarshalJSON() ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return json.Marshal(map[string]interface{}{"pool": mp.Pool})
+}
+
 func (mp *MemPool) AddToPool(tx *Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
 	mp.Pool[hex.EncodeToString(tx.ID)] = tx
 }
 
 func (mp *MemPool) AddAllToPool(txs []*Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
 	for _, tx := range txs {
 		mp.Pool[hex.EncodeToString(tx.ID)] = tx
 	}
 }
 
+// Get the transactions in the pool ordered by sender and nonce
+// so that the nonces of every sender increase
 func (mp *MemPool) GetTransactions(count int) (txs []*Transaction) {
-	i := 0
-	txs = make([]*Transaction, 0)
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	txs = make([]*Transaction, 0, len(mp.Pool))
 	for _, tx := range mp.Pool {
 		txs = append(txs, tx)
-		i++
-		if i == count {
-			break
+	}
+
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].Sender != txs[j].Sender {
+			return txs[i].Sender < txs[j].Sender
 		}
+		return txs[i].Nonce < txs[j].Nonce
+	})
+
+	if len(txs) > count {
+		txs = txs[:count]
 	}
 
 	return txs
 }
 
+func (mp *MemPool) Size() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return len(mp.Pool)
+}
+
+// Check if the pool has a transaction from the sender with the given nonce
+func (mp *MemPool) HasNonce(sender string, nonce uint64) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	for _, tx := range mp.Pool {
+		if tx.Sender == sender && tx.Nonce == nonce {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the highest nonce of the transactions of the sender in the pool
+func (mp *MemPool) MaxNonce(sender string) uint64 {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	nonce := uint64(0)
+	for _, tx := range mp.Pool {
+		if tx.Sender == sender && tx.Nonce > nonce {
+			nonce = tx.Nonce
+		}
+	}
+
+	return nonce
+}
+
 func (mp *MemPool) Remove(tx *Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
 	delete(mp.Pool, hex.EncodeToString(tx.ID))
 }
 
 func (mp *MemPool) RemoveAll(txs []*Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
 	for _, tx := range txs {
 		delete(mp.Pool, hex.EncodeToString(tx.ID))
 	}
 }
+
+// Remove all the transactions for which the predicate is true
+func (mp *MemPool) RemoveIf(predicate func(tx *Transaction) bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for id, tx := range mp.Pool {
+		if predicate(tx) {
+			delete(mp.Pool, id)
+		}
+	}
+}
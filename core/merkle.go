@@ -1,9 +1,23 @@
 package core
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+var ErrTxNotInTree = errors.New("transaction not found in merkle tree")
+
+// Prefixes separating the leaves from the inner nodes in the canonical construction
+const (
+	MerkleLeafPrefix byte = 0x00
+	MerkleNodePrefix byte = 0x01
+)
 
 type MerkleTree struct {
 	Root *MerkleNode
+	// Version of the block format which determines the construction of the tree
+	Version uint32
 }
 
 type MerkleNode struct {
@@ -32,7 +46,74 @@ func NewMerkleNode(left *MerkleNode, right *MerkleNode, hash []byte) *MerkleNode
 }
 
 // Construct the merkle tree given the array of hashes of transactions
-func NewMerkleTree(txHashes [][]byte) *MerkleTree {
+// using the construction of the given block format version
+func NewMerkleTree(version uint32, txHashes [][]byte) *MerkleTree {
+	if !HasRule(version, RuleCanonicalMerkleTree) {
+		return newLegacyMerkleTree(txHashes)
+	}
+
+	return newCanonicalMerkleTree(txHashes)
+}
+
+// Hash of the leaf of a transaction
+func MerkleLeafHash(version uint32, txID []byte) []byte {
+	if !HasRule(version, RuleCanonicalMerkleTree) {
+		return txID
+	}
+
+	hash := sha256.Sum256(bytes.Join([][]byte{{MerkleLeafPrefix}, txID}, []byte{}))
+	return hash[:]
+}
+
+// Hash of an inner node from the hashes of its children
+func MerkleNodeHash(version uint32, left, right []byte) []byte {
+	if !HasRule(version, RuleCanonicalMerkleTree) {
+		hash := sha256.Sum256(bytes.Join([][]byte{left, right}, []byte{}))
+		return hash[:]
+	}
+
+	hash := sha256.Sum256(bytes.Join([][]byte{{MerkleNodePrefix}, left, right}, []byte{}))
+	return hash[:]
+}
+
+// Canonical construction used from block version 2:
+//  1. The tree of no transactions has the root SHA256("")
+//  2. A leaf is SHA256(0x00 || txID)
+//  3. An inner node is SHA256(0x01 || left || right)
+//  4. If a level has an odd number of nodes then the last node is promoted to the next level unchanged
+func newCanonicalMerkleTree(txHashes [][]byte) *MerkleTree {
+	if len(txHashes) == 0 {
+		hash := sha256.Sum256([]byte{})
+		return &MerkleTree{Root: &MerkleNode{Hash: hash[:]}, Version: RuleVersion(RuleCanonicalMerkleTree)}
+	}
+
+	nodes := make([]*MerkleNode, 0, len(txHashes))
+	for _, txID := range txHashes {
+		nodes = append(nodes, &MerkleNode{Hash: MerkleLeafHash(RuleVersion(RuleCanonicalMerkleTree), txID)})
+	}
+
+	for len(nodes) > 1 {
+		var nextLevel []*MerkleNode
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 == len(nodes) {
+				nextLevel = append(nextLevel, nodes[i])
+				continue
+			}
+
+			nextLevel = append(nextLevel, &MerkleNode{
+				Left:  nodes[i],
+				Right: nodes[i+1],
+				Hash:  MerkleNodeHash(RuleVersion(RuleCanonicalMerkleTree), nodes[i].Hash, nodes[i+1].Hash),
+			})
+		}
+		nodes = nextLevel
+	}
+
+	return &MerkleTree{Root: nodes[0], Version: RuleVersion(RuleCanonicalMerkleTree)}
+}
+
+// Construction used by the blocks of version 1, kept so that the old blocks still validate
+func newLegacyMerkleTree(txHashes [][]byte) *MerkleTree {
 	nodes := make([]*MerkleNode, 0)
 
 	// Create the leaf nodes of the tree
@@ -42,7 +123,7 @@ func NewMerkleTree(txHashes [][]byte) *MerkleTree {
 	}
 
 	if len(nodes) == 0 {
-		return &MerkleTree{NewMerkleNode(nil, nil, []byte("0"))}
+		return &MerkleTree{Root: NewMerkleNode(nil, nil, []byte("0")), Version: BlockVersion1}
 	}
 
 	// Make the leaf nodes even by duplicating the last node
@@ -67,5 +148,62 @@ func NewMerkleTree(txHashes [][]byte) *MerkleTree {
 		nodes = nextLevel
 	}
 
-	return &MerkleTree{nodes[0]}
+	return &MerkleTree{Root: nodes[0], Version: BlockVersion1}
+}
+
+// Step of a merkle proof containing the hash of the sibling node on the path to the root
+type MerkleProofStep struct {
+	Hash []byte `json:"hash"`
+	// If the sibling is the left child of the parent
+	Left bool `json:"left"`
+}
+
+// MerkleProof proves that a transaction is included in a tree with a given root.
+// The steps are ordered from the leaf to the root.
+type MerkleProof struct {
+	Version uint32            `json:"version"`
+	TxID    []byte            `json:"txid"`
+	Steps   []MerkleProofStep `json:"steps"`
+}
+
+// Generate the proof of inclusion of the transaction with the given ID
+func (t *MerkleTree) Proof(txID []byte) (*MerkleProof, error) {
+	steps, ok := proofPath(t.Root, MerkleLeafHash(t.Version, txID))
+	if !ok {
+		return nil, ErrTxNotInTree
+	}
+
+	return &MerkleProof{Version: t.Version, TxID: txID, Steps: steps}, nil
+}
+
+// Find the path from the leaf with the given hash up to the node
+func proofPath(node *MerkleNode, leafHash []byte) ([]MerkleProofStep, bool) {
+	if node.Left == nil && node.Right == nil {
+		return []MerkleProofStep{}, bytes.Equal(node.Hash, leafHash)
+	}
+
+	if steps, ok := proofPath(node.Left, leafHash); ok {
+		return append(steps, MerkleProofStep{Hash: node.Right.Hash, Left: false}), true
+	}
+
+	if steps, ok := proofPath(node.Right, leafHash); ok {
+		return append(steps, MerkleProofStep{Hash: node.Left.Hash, Left: true}), true
+	}
+
+	return nil, false
+}
+
+// Verify that the proof leads from the transaction ID to the given merkle root.
+// The version of the proof must match the version of the block the root belongs to.
+func VerifyMerkleProof(root []byte, proof *MerkleProof) bool {
+	hash := MerkleLeafHash(proof.Version, proof.TxID)
+	for _, step := range proof.Steps {
+		if step.Left {
+			hash = MerkleNodeHash(proof.Version, step.Hash, hash)
+		} else {
+			hash = MerkleNodeHash(proof.Version, hash, step.Hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
 }
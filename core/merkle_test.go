@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// IDs of the transactions of the test vectors, txN is SHA256("txN")
+func vectorTxIDs(count int) [][]byte {
+	ids := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("tx%d", i)))
+		ids = append(ids, hash[:])
+	}
+	return ids
+}
+
+func TestCanonicalMerkleRootVectors(t *testing.T) {
+	vectors := []struct {
+		count int
+		root  string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "5e0bee3b0a2e783a0e43a5b93c5d769ad07969cb6213d009763153f07134fca3"},
+		{2, "cd8e9a192f1c2b8e3a7e36dbef6ef90cac12fed7f2d18e4daf169a304f6b2438"},
+		{3, "4c13e5e804cf591f35c2beaba7bfa3a284e107f9dae70a729ff99a1c5e8b4e61"},
+		{4, "15756b165b28a8d9a1c1aaf5a46ee2f5b04038bb39444d45dfb058fdb5b6b37e"},
+		{5, "2a93a1df25ab1da8500ec53ae9a3e90a41d55a410a4f2cb50a0ba2d8d5b626bb"},
+		{7, "d8db8c3a291d6fbffb4abf03268f80df8917cfa825b06d62e5659f86c92aea2f"},
+	}
+
+	for _, v := range vectors {
+		root := NewMerkleTree(RuleVersion(RuleCanonicalMerkleTree), vectorTxIDs(v.count)).Root.Hash
+		if got := hex.EncodeToString(root); got != v.root {
+			t.Errorf("root of %d transactions is %s, want %s", v.count, got, v.root)
+		}
+	}
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	for _, version := range []uint32{BlockVersion1, RuleVersion(RuleCanonicalMerkleTree), CurrentBlockVersion} {
+		for count := 1; count <= 8; count++ {
+			ids := vectorTxIDs(count)
+			tree := NewMerkleTree(version, ids)
+
+			for i, id := range ids {
+				proof, err := tree.Proof(id)
+				if err != nil {
+					t.Fatalf("version %d, %d transactions: proof of tx%d: %s", version, count, i, err)
+				}
+				if !VerifyMerkleProof(tree.Root.Hash, proof) {
+					t.Errorf("version %d, %d transactions: proof of tx%d does not verify", version, count, i)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejectsTampering(t *testing.T) {
+	ids := vectorTxIDs(5)
+	tree := NewMerkleTree(RuleVersion(RuleCanonicalMerkleTree), ids)
+
+	proof, err := tree.Proof(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A proof for another transaction ID
+	other := *proof
+	other.TxID = vectorTxIDs(6)[5]
+	if VerifyMerkleProof(tree.Root.Hash, &other) {
+		t.Error("proof verifies for a transaction that is not in the tree")
+	}
+
+	// A proof with a changed sibling hash
+	tampered := *proof
+	tampered.Steps = append([]MerkleProofStep{}, proof.Steps...)
+	tampered.Steps[0].Hash = bytes.Repeat([]byte{0xff}, sha256.Size)
+	if VerifyMerkleProof(tree.Root.Hash, &tampered) {
+		t.Error("proof verifies with a tampered sibling")
+	}
+
+	// An inner node can not be presented as a transaction
+	inner := &MerkleProof{Version: RuleVersion(RuleCanonicalMerkleTree), TxID: tree.Root.Left.Hash, Steps: []MerkleProofStep{{Hash: tree.Root.Right.Hash}}}
+	if VerifyMerkleProof(tree.Root.Hash, inner) {
+		t.Error("inner node verifies as a transaction")
+	}
+
+	if _, err := tree.Proof(vectorTxIDs(6)[5]); !errors.Is(err, ErrTxNotInTree) {
+		t.Errorf("proof of a missing transaction returned %v", err)
+	}
+}
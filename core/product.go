@@ -0,0 +1,596 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotHolder        = errors.New("sender is not the holder of the product")
+	ErrOfferRequired    = errors.New("transition transfers custody and must be offered to the receiver")
+	ErrNoOffer          = errors.New("no pending offer matches the transaction")
+	ErrNotOfferReceiver = errors.New("sender is not the receiver of the offer")
+	ErrOfferExpired     = errors.New("offer has expired")
+	ErrInvalidKind      = errors.New("kind of transaction is not allowed")
+	ErrInvalidLot       = errors.New("products can only be added to a new lot and must not exist")
+	ErrProductPacked    = errors.New("product can only be moved with the product it is packed in")
+	ErrInvalidPacking   = errors.New("packed products must be held by the sender and have the same status as their container")
+	ErrNotManufacturer  = errors.New("sender is not the manufacturer of the product")
+	ErrAlreadyRecalled  = errors.New("product has already been recalled")
+)
+
+// Transaction of a product along with the block it was included in
+type ProductEvent struct {
+	Transaction    *Transaction `json:"transaction"`
+	BlockHeight    uint         `json:"blockheight"`
+	BlockTimestamp int64        `json:"blocktimestamp"`
+}
+
+// Transfer of the custody of a product from one holder to the next
+type CustodyHop struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	TxID           []byte `json:"txid"`
+	BlockHeight    uint   `json:"blockheight"`
+	BlockTimestamp int64  `json:"blocktimestamp"`
+}
+
+// Offer of the holder of a product to move it to a status and transfer it to the receiver
+type PendingOffer struct {
+	TxID   []byte            `json:"txid"`
+	From   string            `json:"from"`
+	To     string            `json:"to"`
+	Status TransactionStatus `json:"status"`
+	// Height of the block which contains the offer
+	Height uint `json:"height"`
+}
+
+// Check if the offer can no longer be accepted in the block at the given height
+func (o *PendingOffer) Expired(height uint, expiry uint) bool {
+	return height > o.Height+expiry
+}
+
+// Recall of a product by its manufacturer
+type ProductRecall struct {
+	TxID         []byte `json:"txid"`
+	Manufacturer string `json:"manufacturer"`
+	// Product named by the recall, which is the product itself or a product it was packed in
+	ProductID      string `json:"productid"`
+	BlockHeight    uint   `json:"blockheight"`
+	BlockTimestamp int64  `json:"blocktimestamp"`
+}
+
+// Return of a product by the consumer
+type ProductReturn struct {
+	// Holder of the product when it was moved to the first state of the return
+	Consumer       string `json:"consumer"`
+	TxID           []byte `json:"txid"`
+	BlockHeight    uint   `json:"blockheight"`
+	BlockTimestamp int64  `json:"blocktimestamp"`
+	// The return has been received and the consumer is owed a refund
+	Refunded     bool `json:"refunded"`
+	RefundHeight uint `json:"refundheight,omitempty"`
+}
+
+// Current state of a product and the history of its transactions
+type ProductState struct {
+	ProductID       string            `json:"productid"`
+	Status          TransactionStatus `json:"status"`
+	Holder          string            `json:"holder"`
+	LastTransaction *Transaction      `json:"lasttransaction"`
+	History         []ProductEvent    `json:"history"`
+	// Every change of the holder of the product in order
+	Hops []CustodyHop `json:"hops"`
+	// Offer of the holder which has not been accepted or rejected yet
+	Offer *PendingOffer `json:"offer,omitempty"`
+	// Node whose shipment of the product is open. A shipment is opened when a node offers
+	// or hands over the product and is closed when the next holder moves it on
+	Shipper string `json:"shipper,omitempty"`
+	// Products packed in the product, including the products of a lot
+	Products []string `json:"products,omitempty"`
+	// Product the product is packed in. A packed product inherits the movements of its container
+	Container string `json:"container,omitempty"`
+	// Sender of the transaction which created the product
+	Manufacturer string `json:"manufacturer"`
+	// Recall of the product, or nil if it has not been recalled
+	Recall *ProductRecall `json:"recall,omitempty"`
+	// Last return of the product, or nil if it has never been returned
+	Return *ProductReturn `json:"return,omitempty"`
+}
+
+// Part of the state of a product which is changed by its transactions
+type productView struct {
+	exists       bool
+	status       TransactionStatus
+	holder       string
+	offer        *PendingOffer
+	shipper      string
+	container    string
+	manufacturer string
+	recalled     bool
+	// Products packed in the product, which must not be changed in place since they may be shared with the state
+	contents []string
+}
+
+func (p *ProductState) view() productView {
+	return productView{
+		exists:       true,
+		status:       p.Status,
+		holder:       p.Holder,
+		offer:        p.Offer,
+		shipper:      p.Shipper,
+		container:    p.Container,
+		manufacturer: p.Manufacturer,
+		recalled:     p.Recall != nil,
+		contents:     p.Products,
+	}
+}
+
+// Check that the transaction can be applied to the product in a block of the given version and height.
+// The lookup function gets the state of the other products of the transaction.
+func (s *State) checkProductTransaction(version uint32, height uint, product productView, tx *Transaction, roles map[string]string, lookup func(productID string) productView) error {
+	// A packed product can still be recalled by its manufacturer
+	if product.container != "" && tx.Kind != Recall {
+		return fmt.Errorf("product %s is packed in %s: %w", tx.ProductID, product.container, ErrProductPacked)
+	}
+	if tx.Kind != Transfer && !HasRule(version, RuleCustodyOffers) {
+		return ErrInvalidKind
+	}
+
+	switch tx.Kind {
+	case Accept, Reject:
+		offer := product.offer
+		if offer == nil || !bytes.Equal(offer.TxID, tx.OfferID) || offer.Status != tx.Status {
+			return fmt.Errorf("product %s: %w", tx.ProductID, ErrNoOffer)
+		}
+		if tx.Sender != offer.To {
+			return fmt.Errorf("offer of product %s is for %s and not %s: %w", tx.ProductID, offer.To, tx.Sender, ErrNotOfferReceiver)
+		}
+		if tx.Kind == Accept && offer.Expired(height, s.Lifecycle.OfferExpiry) {
+			return fmt.Errorf("offer of product %s: %w", tx.ProductID, ErrOfferExpired)
+		}
+		if len(tx.Products) > 0 {
+			return fmt.Errorf("lot %s: %w", tx.ProductID, ErrInvalidLot)
+		}
+		return nil
+
+	case Transfer, Offer:
+		if HasRule(version, RuleLifecycleRoles) {
+			if err := s.Lifecycle.CanTransition(product.status, tx.Status, roles[tx.Sender]); err != nil {
+				return fmt.Errorf("%s with role %q can not move product %s from %d to %d: %w", tx.Sender, roles[tx.Sender], tx.ProductID, product.status, tx.Status, err)
+			}
+		} else if _, ok := s.Lifecycle.Transition(product.status, tx.Status); !ok {
+			return fmt.Errorf("product %s can not move from %d to %d: %w", tx.ProductID, product.status, tx.Status, ErrInvalidTransition)
+		}
+
+		if HasRule(version, RuleHolderMovesProduct) && product.holder != "" && tx.Sender != product.holder {
+			return fmt.Errorf("product %s is held by %s and not by %s: %w", tx.ProductID, product.holder, tx.Sender, ErrNotHolder)
+		}
+
+		// Custody only changes when the receiver accepts an offer
+		if HasRule(version, RuleCustodyOffers) {
+			transition, _ := s.Lifecycle.Transition(product.status, tx.Status)
+			if tx.Kind == Transfer && transition.TransfersCustody {
+				return fmt.Errorf("product %s: %w", tx.ProductID, ErrOfferRequired)
+			}
+			if tx.Kind == Offer && !transition.TransfersCustody {
+				return fmt.Errorf("product %s can be moved to %d without an offer: %w", tx.ProductID, tx.Status, ErrInvalidKind)
+			}
+		}
+
+		return checkLot(version, product, tx, lookup)
+
+	case Pack, Unpack:
+		if !HasRule(version, RulePacking) {
+			return ErrInvalidKind
+		}
+
+		return checkPacking(product, tx, lookup)
+
+	case Recall:
+		if !HasRule(version, RuleRecalls) {
+			return ErrInvalidKind
+		}
+
+		return checkRecall(version, product, tx, lookup)
+	}
+
+	return ErrInvalidKind
+}
+
+// Check that the products of the transaction can be added to the lot that is created by it.
+// The products must not exist yet.
+func checkLot(version uint32, product productView, tx *Transaction, lookup func(productID string) productView) error {
+	if len(tx.Products) == 0 {
+		return nil
+	}
+
+	if !HasRule(version, RuleLots) {
+		return fmt.Errorf("lot %s: %w", tx.ProductID, ErrInvalidLot)
+	}
+	if product.exists {
+		return fmt.Errorf("lot %s already exists: %w", tx.ProductID, ErrInvalidLot)
+	}
+
+	seen := make(map[string]bool)
+	for _, productID := range tx.Products {
+		if productID == tx.ProductID || seen[productID] || lookup(productID).exists {
+			return fmt.Errorf("product %s can not be added to lot %s: %w", productID, tx.ProductID, ErrInvalidLot)
+		}
+		seen[productID] = true
+	}
+
+	return nil
+}
+
+// Check that the products of the transaction can be packed in or unpacked from the product of the transaction.
+// Products are packed in a product that does not exist yet or is held by the sender, and the status
+// of the transaction must be the status of the product, which is not changed by packing.
+func checkPacking(container productView, tx *Transaction, lookup func(productID string) productView) error {
+	if len(tx.Products) == 0 {
+		return fmt.Errorf("no products to pack in %s: %w", tx.ProductID, ErrInvalidPacking)
+	}
+
+	if container.exists {
+		if container.holder != tx.Sender {
+			return fmt.Errorf("product %s is held by %s and not by %s: %w", tx.ProductID, container.holder, tx.Sender, ErrNotHolder)
+		}
+		if container.status != tx.Status || container.offer != nil {
+			return fmt.Errorf("product %s: %w", tx.ProductID, ErrInvalidPacking)
+		}
+	} else if tx.Kind == Unpack {
+		return fmt.Errorf("product %s does not exist: %w", tx.ProductID, ErrInvalidPacking)
+	}
+
+	seen := make(map[string]bool)
+	for _, productID := range tx.Products {
+		product := lookup(productID)
+		if productID == tx.ProductID || seen[productID] || !product.exists {
+			return fmt.Errorf("product %s: %w", productID, ErrInvalidPacking)
+		}
+		seen[productID] = true
+
+		if tx.Kind == Unpack {
+			if product.container != tx.ProductID {
+				return fmt.Errorf("product %s is not packed in %s: %w", productID, tx.ProductID, ErrInvalidPacking)
+			}
+			continue
+		}
+
+		if product.container != "" {
+			return fmt.Errorf("product %s is packed in %s: %w", productID, product.container, ErrProductPacked)
+		}
+		if product.holder != tx.Sender || product.status != tx.Status || product.offer != nil {
+			return fmt.Errorf("product %s can not be packed in %s: %w", productID, tx.ProductID, ErrInvalidPacking)
+		}
+	}
+
+	return nil
+}
+
+// Check that the sender of the transaction is the manufacturer of the product and it has not been recalled yet.
+// With RuleRecallOwnProducts the sender must also be the manufacturer of every product packed in the product.
+func checkRecall(version uint32, product productView, tx *Transaction, lookup func(productID string) productView) error {
+	if !product.exists {
+		return fmt.Errorf("product %s does not exist: %w", tx.ProductID, ErrNotManufacturer)
+	}
+	if tx.Sender != product.manufacturer {
+		return fmt.Errorf("product %s was manufactured by %s and not by %s: %w", tx.ProductID, product.manufacturer, tx.Sender, ErrNotManufacturer)
+	}
+	if product.recalled {
+		return fmt.Errorf("product %s: %w", tx.ProductID, ErrAlreadyRecalled)
+	}
+	if len(tx.Products) > 0 {
+		return fmt.Errorf("recall of product %s can not name other products: %w", tx.ProductID, ErrInvalidKind)
+	}
+	if !HasRule(version, RuleRecallOwnProducts) {
+		return nil
+	}
+
+	return checkRecallContents(product, tx, lookup)
+}
+
+// Check that the sender of the recall is the manufacturer of all the products packed in the container
+func checkRecallContents(container productView, tx *Transaction, lookup func(productID string) productView) error {
+	for _, productID := range container.contents {
+		product := lookup(productID)
+		if product.manufacturer != tx.Sender {
+			return fmt.Errorf("product %s packed in %s was manufactured by %s and not by %s: %w", productID, tx.ProductID, product.manufacturer, tx.Sender, ErrNotManufacturer)
+		}
+		if err := checkRecallContents(product, tx, lookup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the state of the product after the transaction in the block at the given height is applied to it
+func (s *State) nextProduct(product productView, tx *Transaction, height uint) productView {
+	// The sender of the first transaction of a product is its manufacturer
+	if !product.exists {
+		product.manufacturer = tx.Sender
+	}
+
+	switch tx.Kind {
+	case Offer:
+		// The sender holds a product it creates until the offer is accepted
+		if product.holder == "" {
+			product.holder = tx.Sender
+		}
+		product.offer = &PendingOffer{
+			TxID:   tx.ID,
+			From:   tx.Sender,
+			To:     tx.Receiver,
+			Status: tx.Status,
+			Height: height,
+		}
+		product.shipper = tx.Sender
+
+	case Accept:
+		if product.offer != nil {
+			product.status = product.offer.Status
+			product.holder = product.offer.To
+		}
+		product.offer = nil
+
+	case Reject:
+		product.offer = nil
+		product.shipper = ""
+
+	case Pack, Unpack:
+		// A product that is created by packing has the holder and status of its contents
+		if !product.exists {
+			product.status = tx.Status
+			product.holder = tx.Sender
+		}
+		// Packing is done by the holder, which closes the shipment to it
+		product.shipper = ""
+
+	case Recall:
+		// A recall does not move the product
+		product.recalled = true
+
+	default:
+		product.holder = s.nextHolder(product.status, tx)
+		product.status = tx.Status
+		product.offer = nil
+
+		// The shipment stays open until the next holder moves the product
+		product.shipper = ""
+		if product.holder != tx.Sender {
+			product.shipper = tx.Sender
+		}
+	}
+
+	// Products packed in the product or created with it as a lot
+	if tx.Kind == Unpack {
+		contents := make([]string, 0, len(product.contents))
+		for _, productID := range product.contents {
+			if !containsString(tx.Products, productID) {
+				contents = append(contents, productID)
+			}
+		}
+		product.contents = contents
+	} else if len(tx.Products) > 0 {
+		product.contents = append(append([]string{}, product.contents...), tx.Products...)
+	}
+
+	product.exists = true
+	return product
+}
+
+// Get the state of the products of the transaction after it is applied to the container with the given state
+func nextContents(container productView, tx *Transaction, lookup func(productID string) productView) map[string]productView {
+	contents := make(map[string]productView)
+	for _, productID := range tx.Products {
+		switch tx.Kind {
+		case Pack:
+			product := lookup(productID)
+			product.container = tx.ProductID
+			product.shipper = ""
+			contents[productID] = product
+
+		case Unpack:
+			product := lookup(productID)
+			product.status = container.status
+			product.holder = container.holder
+			product.container = ""
+			contents[productID] = product
+
+		default:
+			// The products of a new lot
+			contents[productID] = productView{
+				exists:       true,
+				status:       container.status,
+				holder:       container.holder,
+				container:    tx.ProductID,
+				manufacturer: container.manufacturer,
+			}
+		}
+	}
+
+	return contents
+}
+
+// Get the holder of a product after the transaction moves it from the given status.
+// The receiver becomes the holder unless the transition keeps the product with the sender.
+func (s *State) nextHolder(from TransactionStatus, tx *Transaction) string {
+	transition, ok := s.Lifecycle.Transition(from, tx.Status)
+	if ok && !transition.TransfersCustody {
+		return tx.Sender
+	}
+
+	return tx.Receiver
+}
+
+func (s *State) applyProductTransaction(tx *Transaction, block *Block) {
+	var current productView
+	if product, ok := s.Products[tx.ProductID]; ok {
+		current = product.view()
+	}
+
+	next := s.nextProduct(current, tx, block.Height)
+	product := s.getOrCreateProduct(tx.ProductID)
+	product.Manufacturer = next.manufacturer
+
+	// Pack the products or create the products of a new lot so that they move with the product
+	if tx.Kind != Unpack {
+		for _, productID := range tx.Products {
+			child, ok := s.Products[productID]
+			if !ok {
+				// The products of a lot are manufactured with the lot
+				child = s.getOrCreateProduct(productID)
+				child.Manufacturer = product.Manufacturer
+			}
+			child.Container = product.ProductID
+			s.setShipper(child, "")
+			product.Products = append(product.Products, productID)
+		}
+	}
+
+	s.setShipper(product, next.shipper)
+	product.Offer = next.offer
+	s.moveProduct(product, next.status, next.holder, tx, block)
+
+	// Unpacked products keep the state of the product they were packed in
+	if tx.Kind == Unpack {
+		for _, productID := range tx.Products {
+			s.Products[productID].Container = ""
+			product.Products = removeString(product.Products, productID)
+		}
+	}
+
+	if tx.Kind == Recall {
+		s.recallProduct(product, &ProductRecall{
+			TxID:           tx.ID,
+			Manufacturer:   tx.Sender,
+			ProductID:      tx.ProductID,
+			BlockHeight:    block.Height,
+			BlockTimestamp: block.Timestamp,
+		})
+	}
+}
+
+func (s *State) getOrCreateProduct(productID string) *ProductState {
+	product, ok := s.Products[productID]
+	if !ok {
+		product = &ProductState{ProductID: productID}
+		s.Products[productID] = product
+	}
+
+	return product
+}
+
+// Record the transaction in the history of the product and of all the products packed in it
+// and move them to the status and holder
+func (s *State) moveProduct(product *ProductState, status TransactionStatus, holder string, tx *Transaction, block *Block) {
+	if holder != product.Holder {
+		from := product.Holder
+		if from == "" {
+			from = tx.Sender
+		}
+
+		if from != holder {
+			product.Hops = append(product.Hops, CustodyHop{
+				From:           from,
+				To:             holder,
+				TxID:           tx.ID,
+				BlockHeight:    block.Height,
+				BlockTimestamp: block.Timestamp,
+			})
+		}
+	}
+
+	s.trackReturn(product, status, tx, block)
+
+	product.Status = status
+	product.Holder = holder
+	product.LastTransaction = tx
+	product.History = append(product.History, ProductEvent{
+		Transaction:    tx,
+		BlockHeight:    block.Height,
+		BlockTimestamp: block.Timestamp,
+	})
+
+	for _, productID := range product.Products {
+		if child, ok := s.Products[productID]; ok {
+			s.moveProduct(child, status, holder, tx, block)
+		}
+	}
+}
+
+// Start a return when the product moves into the return states and mark the return
+// as refunded when the product reaches a refund state
+func (s *State) trackReturn(product *ProductState, status TransactionStatus, tx *Transaction, block *Block) {
+	if status == product.Status || !s.Lifecycle.IsReturn(status) {
+		return
+	}
+
+	if !s.Lifecycle.IsReturn(product.Status) {
+		product.Return = &ProductReturn{
+			Consumer:       product.Holder,
+			TxID:           tx.ID,
+			BlockHeight:    block.Height,
+			BlockTimestamp: block.Timestamp,
+		}
+	}
+	if product.Return != nil && !product.Return.Refunded && s.Lifecycle.IsRefund(status) {
+		product.Return.Refunded = true
+		product.Return.RefundHeight = block.Height
+	}
+}
+
+// Mark the product and all the products packed in it as recalled.
+// Products which were already recalled keep their earlier recall.
+func (s *State) recallProduct(product *ProductState, recall *ProductRecall) {
+	if product.Recall == nil {
+		product.Recall = recall
+	}
+
+	for _, productID := range product.Products {
+		if child, ok := s.Products[productID]; ok {
+			s.recallProduct(child, recall)
+		}
+	}
+}
+
+// Open or close the shipment of the product
+func (s *State) setShipper(product *ProductState, shipper string) {
+	if shipper == product.Shipper {
+		return
+	}
+
+	if product.Shipper != "" {
+		delete(s.Shipments[product.Shipper], product.ProductID)
+	}
+	if shipper != "" {
+		if s.Shipments[shipper] == nil {
+			s.Shipments[shipper] = make(map[string]bool)
+		}
+		s.Shipments[shipper][product.ProductID] = true
+	}
+
+	product.Shipper = shipper
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i], values[i+1:]...)
+		}
+	}
+
+	return values
+}
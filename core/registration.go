@@ -0,0 +1,44 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidRegistration = errors.New("registration must name a role of the lifecycle and can not move products")
+	ErrAlreadyRegistered   = errors.New("role of the node is already registered")
+)
+
+// Check that the registration can be added to a block of the given version.
+// The roles are the roles registered on the chain and by the earlier transactions of the block.
+func (s *State) checkRegistration(version uint32, tx *Transaction, roles map[string]string) error {
+	if !HasRule(version, RuleRegisteredRoles) {
+		return ErrInvalidKind
+	}
+	if tx.ProductID != "" || len(tx.Products) > 0 || !s.Lifecycle.HasRole(tx.Role) {
+		return fmt.Errorf("%s registered role %q: %w", tx.Sender, tx.Role, ErrInvalidRegistration)
+	}
+	if role, ok := roles[tx.Sender]; ok {
+		return fmt.Errorf("%s is registered as %s: %w", tx.Sender, role, ErrAlreadyRegistered)
+	}
+
+	return nil
+}
+
+// Record the role of the sender unless it is already registered
+func (s *State) applyRegistration(tx *Transaction) {
+	if _, ok := s.Roles[tx.Sender]; ok {
+		return
+	}
+
+	s.Roles[tx.Sender] = tx.Role
+}
+
+// Get the role registered on the chain by the node, or an empty string if it did not register
+func (s *State) Role(id string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Roles[id]
+}
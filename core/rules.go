@@ -0,0 +1,96 @@
+package core
+
+// Rule of the consensus that was introduced by a version of the block format.
+// A block follows the rules of its version and of all the earlier versions.
+type Rule int
+
+const (
+	// The merkle tree separates the leaves from the inner nodes and the block hash covers the version
+	RuleCanonicalMerkleTree Rule = iota
+	// The block header is hashed in the canonical binary encoding
+	RuleBinaryBlockHash
+	// The transactions carry replay protection
+	RuleReplayProtection
+	// The transactions follow the transitions of the product lifecycle
+	RuleLifecycleTransitions
+	// The senders have a role that is allowed to perform the transition
+	RuleLifecycleRoles
+	// Only the current holder of a product moves it
+	RuleHolderMovesProduct
+	// Custody is offered by the holder and accepted by the receiver
+	RuleCustodyOffers
+	// Transactions can create lots of products
+	RuleLots
+	// Transactions can pack and unpack products
+	RulePacking
+	// Transactions can recall products
+	RuleRecalls
+	// Transactions can stake and vote for the verifiers of the next epochs
+	RuleElections
+	// The proposers take turns among the verifiers
+	RuleProposerTurns
+	// Blocks carry the view in which they were proposed
+	RuleViewChanges
+	// Votes can name any number of candidates or withdraw the earlier vote
+	RuleCandidateLists
+	// Senders have the roles registered on the chain
+	RuleRegisteredRoles
+	// Recalls only reach products of the manufacturer that recalls them
+	RuleRecallOwnProducts
+	// Timestamps are later than the timestamp of the previous block and not in the future
+	RuleForwardTimestamps
+)
+
+// Versions of the block format and the rules each of them introduced.
+// A change of the consensus rules appends the next version with its rules.
+var blockVersions = [...][]Rule{
+	// Blocks stored before the version was introduced have version 0 and are treated as version 1
+	0:  nil,
+	1:  nil,
+	2:  {RuleCanonicalMerkleTree},
+	3:  {RuleBinaryBlockHash},
+	4:  {RuleReplayProtection},
+	5:  {RuleLifecycleTransitions},
+	6:  {RuleLifecycleRoles},
+	7:  {RuleHolderMovesProduct},
+	8:  {RuleCustodyOffers},
+	9:  {RuleLots},
+	10: {RulePacking},
+	11: {RuleRecalls},
+	12: {RuleElections},
+	13: {RuleProposerTurns},
+	14: {RuleViewChanges},
+	15: {RuleCandidateLists},
+	16: {RuleRegisteredRoles},
+	17: {RuleRecallOwnProducts},
+	18: {RuleForwardTimestamps},
+}
+
+const (
+	// Blocks with the legacy merkle tree construction
+	BlockVersion1 uint32 = 1
+	// Version of the blocks proposed by this node
+	CurrentBlockVersion = uint32(len(blockVersions) - 1)
+)
+
+// Version of the block format which introduced every rule
+var ruleVersions = func() map[Rule]uint32 {
+	versions := make(map[Rule]uint32)
+	for version, rules := range blockVersions {
+		for _, rule := range rules {
+			versions[rule] = uint32(version)
+		}
+	}
+
+	return versions
+}()
+
+// Get the version of the block format which introduced the rule
+func RuleVersion(rule Rule) uint32 {
+	return ruleVersions[rule]
+}
+
+// Check if blocks of the given version follow the rule
+func HasRule(version uint32, rule Rule) bool {
+	return version >= ruleVersions[rule]
+}
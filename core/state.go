@@ -0,0 +1,218 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// State of the chain derived by applying its blocks in order
+type State struct {
+	mu        sync.RWMutex
+	ChainID   string     `json:"chainid"`
+	Lifecycle *Lifecycle `json:"-"`
+	Election  Election   `json:"-"`
+	// Height of the last block applied to the state
+	Height uint `json:"height"`
+	// Highest nonce used by every sender
+	Nonces map[string]uint64 `json:"nonces"`
+	// State of every product indexed by the product ID
+	Products map[string]*ProductState `json:"products"`
+	// Height of the block of every transaction indexed by the hex encoded transaction ID
+	Transactions map[string]uint `json:"transactions"`
+	// IDs of the products of the open shipments of every node
+	Shipments map[string]map[string]bool `json:"shipments"`
+	// Amount staked by every node
+	Stakes map[string]uint64 `json:"stakes"`
+	// Candidates voted for by every node
+	Votes map[string][]string `json:"votes"`
+	// Number of epochs that ended
+	Epoch uint `json:"epoch"`
+	// Verifiers elected at the end of the last epoch
+	Verifiers []string `json:"verifiers"`
+	// Role in the product lifecycle registered by every node
+	Roles map[string]string `json:"roles"`
+}
+
+func NewState(chainID string, lifecycle *Lifecycle, election Election) *State {
+	return &State{
+		ChainID:      chainID,
+		Lifecycle:    lifecycle,
+		Election:     election,
+		Nonces:       make(map[string]uint64),
+		Products:     make(map[string]*ProductState),
+		Transactions: make(map[string]uint),
+		Shipments:    make(map[string]map[string]bool),
+		Stakes:       make(map[string]uint64),
+		Votes:        make(map[string][]string),
+		Roles:        make(map[string]string),
+		Verifiers:    append([]string{}, election.Bootstrap...),
+	}
+}
+
+// Fields of the state which are serialized
+type stateJSON State
+
+// Serialize the state while holding its lock so that it is not changed by a block that is applied
+func (s *State) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return json.Marshal((*stateJSON)(s))
+}
+
+// Apply the transactions of the block which extends the last applied block
+func (s *State) Apply(block *Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		if tx.Version >= TransactionVersion3 && tx.Nonce > s.Nonces[tx.Sender] {
+			s.Nonces[tx.Sender] = tx.Nonce
+		}
+
+		s.Transactions[hex.EncodeToString(tx.ID)] = block.Height
+		if tx.Kind == Register {
+			s.applyRegistration(tx)
+			continue
+		}
+		if tx.Kind == Stake || tx.Kind == Vote {
+			s.applyElectionTransaction(tx)
+			continue
+		}
+		s.applyProductTransaction(tx, block)
+	}
+
+	s.Height = block.Height
+	s.endEpoch(block.Height)
+}
+
+// Get a copy of the state of the product
+func (s *State) Product(productID string) (*ProductState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, ok := s.Products[productID]
+	if !ok {
+		return nil, false
+	}
+
+	copied := *product
+	copied.Products = append([]string{}, product.Products...)
+	copied.History = append([]ProductEvent{}, product.History...)
+	copied.Hops = append([]CustodyHop{}, product.Hops...)
+	if product.Offer != nil {
+		offer := *product.Offer
+		copied.Offer = &offer
+	}
+	if product.Recall != nil {
+		recall := *product.Recall
+		copied.Recall = &recall
+	}
+	if product.Return != nil {
+		productReturn := *product.Return
+		copied.Return = &productReturn
+	}
+	return &copied, true
+}
+
+// Get the sorted IDs of the products of the open shipments of the node
+func (s *State) OpenShipments(nodeID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	productIDs := make([]string, 0, len(s.Shipments[nodeID]))
+	for productID := range s.Shipments[nodeID] {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Strings(productIDs)
+
+	return productIDs
+}
+
+// Get the height of the block which contains the transaction
+func (s *State) TransactionHeight(txID []byte) (uint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	height, ok := s.Transactions[hex.EncodeToString(txID)]
+	return height, ok
+}
+
+// Check that the transactions can be applied in order on top of the state in a block of the given version and height.
+// The checks follow the rules of the version (see rules.go). The given roles are only used by the blocks
+// from before the roles were registered on the chain.
+func (s *State) CheckTransitions(version uint32, height uint, txs []*Transaction, roles map[string]string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if HasRule(version, RuleRegisteredRoles) {
+		roles = make(map[string]string, len(s.Roles))
+		for id, role := range s.Roles {
+			roles[id] = role
+		}
+	}
+
+	products := make(map[string]productView)
+	lookup := func(productID string) productView {
+		if product, ok := products[productID]; ok {
+			return product
+		}
+		if product, ok := s.Products[productID]; ok {
+			return product.view()
+		}
+		return productView{}
+	}
+
+	for _, tx := range txs {
+		if tx.Kind == Register {
+			if err := s.checkRegistration(version, tx, roles); err != nil {
+				return err
+			}
+			roles[tx.Sender] = tx.Role
+			continue
+		}
+		if tx.Kind == Stake || tx.Kind == Vote {
+			if err := checkElectionTransaction(version, tx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		product := lookup(tx.ProductID)
+		if err := s.checkProductTransaction(version, height, product, tx, roles, lookup); err != nil {
+			return err
+		}
+
+		next := s.nextProduct(product, tx, height)
+		for productID, content := range nextContents(next, tx, lookup) {
+			products[productID] = content
+		}
+		products[tx.ProductID] = next
+	}
+
+	return nil
+}
+
+// Get the highest nonce used by the sender
+func (s *State) Nonce(sender string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Nonces[sender]
+}
+
+// Check that the transaction can not be a replay of an earlier transaction.
+// The time is the timestamp in milliseconds against which the age of the transaction is checked.
+func (s *State) CheckReplay(tx *Transaction, now int64) error {
+	if err := tx.CheckReplayGuard(s.ChainID, now); err != nil {
+		return err
+	}
+
+	if tx.Nonce <= s.Nonce(tx.Sender) {
+		return ErrStaleNonce
+	}
+
+	return nil
+}
@@ -0,0 +1,599 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+// Chain state with the default lifecycle to which blocks of transactions are applied
+type testChain struct {
+	t      *testing.T
+	state  *State
+	roles  map[string]string
+	nonces map[string]uint64
+}
+
+// Create a chain with the manufacturer m, the distributors d1 and d2 and the consumer c
+func newTestChain(t *testing.T) *testChain {
+	t.Helper()
+
+	return newLifecycleChain(t, DefaultLifecycle(), map[string]string{
+		"m":  "manufacturer",
+		"d1": "distributor",
+		"d2": "distributor",
+		"c":  "consumer",
+	})
+}
+
+// Create a chain with the lifecycle on which the nodes are registered with the given roles
+func newLifecycleChain(t *testing.T, lifecycle *Lifecycle, roles map[string]string) *testChain {
+	t.Helper()
+
+	state := NewState("test", lifecycle, DefaultElection())
+	state.Apply(CreateGenesisBlock())
+
+	c := &testChain{
+		t:      t,
+		state:  state,
+		roles:  roles,
+		nonces: make(map[string]uint64),
+	}
+
+	// The roles are registered on the chain for the blocks from version 16
+	ids := make([]string, 0, len(roles))
+	for id := range roles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	registrations := make([]*Transaction, 0, len(ids))
+	for _, id := range ids {
+		registrations = append(registrations, NewRegisterTransaction(id, roles[id], c.next(id), "test"))
+	}
+	c.apply(registrations...)
+
+	return c
+}
+
+// Create a transaction of the sender with its next nonce
+func (c *testChain) tx(kind TransactionKind, sender, receiver, productID string, status TransactionStatus) *Transaction {
+	c.nonces[sender]++
+	return NewTransaction(kind, sender, receiver, productID, status, c.nonces[sender], "test")
+}
+
+// Check the transactions in the next block of the given version
+func (c *testChain) check(version uint32, txs ...*Transaction) error {
+	return c.state.CheckTransitions(version, c.state.Height+1, txs, c.roles)
+}
+
+// Check the transactions in the next block of the current version and apply the block
+func (c *testChain) apply(txs ...*Transaction) {
+	c.t.Helper()
+
+	if err := c.check(CurrentBlockVersion, txs...); err != nil {
+		c.t.Fatalf("block at height %d: %s", c.state.Height+1, err)
+	}
+	block := NewBlock(txs, nil, c.state.Height+1, 0, "v")
+	c.state.Apply(block)
+}
+
+// Manufacture the product and deliver it to the consumer through the distributor d1
+func (c *testChain) deliver(productID string) {
+	c.t.Helper()
+
+	c.applyOffer("m", "d1", productID, Manufactured)
+	c.applyOffer("d1", "c", productID, Dispatched)
+	c.apply(c.tx(Transfer, "c", "c", productID, Received))
+}
+
+// Offer the product and apply the acceptance of the receiver
+func (c *testChain) applyOffer(sender, receiver, productID string, status TransactionStatus) {
+	c.t.Helper()
+
+	offer := c.tx(Offer, sender, receiver, productID, status)
+	c.apply(offer)
+	c.apply(NewOfferResponse(Accept, receiver, offer, c.next(receiver), "test"))
+}
+
+// Get the last version of the block format before the rule was introduced
+func versionBefore(rule Rule) uint32 {
+	return RuleVersion(rule) - 1
+}
+
+func (c *testChain) next(sender string) uint64 {
+	c.nonces[sender]++
+	return c.nonces[sender]
+}
+
+func (c *testChain) product(productID string) *ProductState {
+	c.t.Helper()
+
+	product, ok := c.state.Product(productID)
+	if !ok {
+		c.t.Fatalf("product %s does not exist", productID)
+	}
+	return product
+}
+
+func TestTransitionsFollowTheLifecycle(t *testing.T) {
+	c := newTestChain(t)
+
+	// A product must be manufactured before it is dispatched or received
+	if err := c.check(RuleVersion(RuleLifecycleTransitions), c.tx(Transfer, "d1", "c", "p", Received)); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("receiving a product that was never manufactured returned %v", err)
+	}
+
+	// The transactions of a block are checked in order
+	manufacture := c.tx(Transfer, "m", "d1", "p", Manufactured)
+	dispatch := c.tx(Transfer, "d1", "d2", "p", Dispatched)
+	if err := c.check(versionBefore(RuleLifecycleRoles), manufacture, dispatch); err != nil {
+		t.Errorf("manufacturing and dispatching in one block returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleLifecycleRoles), dispatch, manufacture); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("dispatching before manufacturing returned %v", err)
+	}
+
+	c.deliver("p")
+	if product := c.product("p"); product.Status != Received || product.Holder != "c" {
+		t.Fatalf("delivered product is %d held by %s", product.Status, product.Holder)
+	}
+
+	// A product can not move back in the lifecycle
+	if err := c.check(CurrentBlockVersion, c.tx(Offer, "c", "d1", "p", Dispatched)); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("moving a received product back returned %v", err)
+	}
+}
+
+func TestLifecycleValidation(t *testing.T) {
+	if _, err := LoadLifecycle("../lifecycle.example.json"); err != nil {
+		t.Errorf("example lifecycle is invalid: %s", err)
+	}
+
+	invalid := []*Lifecycle{
+		{Roles: []string{"a", "a"}},
+		{States: []LifecycleState{{ID: 1, Name: "A"}, {ID: 1, Name: "B"}}},
+		{States: []LifecycleState{{ID: 1, Name: "A", Refund: true}}},
+		{States: []LifecycleState{{ID: 1, Name: "A"}}, Transitions: []LifecycleTransition{{From: "B", To: "A"}}},
+		{Roles: []string{"a"}, States: []LifecycleState{{ID: 1, Name: "A"}}, Transitions: []LifecycleTransition{{To: "A", Roles: []string{"b"}}}},
+	}
+	for i, lifecycle := range invalid {
+		if err := lifecycle.Validate(); err == nil {
+			t.Errorf("invalid lifecycle %d is valid", i)
+		}
+	}
+}
+
+func TestExampleLifecycleCanBeWalked(t *testing.T) {
+	lifecycle, err := LoadLifecycle("../lifecycle.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every state can be reached by a holder with a role that is allowed to move the product there
+	for _, state := range lifecycle.States {
+		if !reachable(lifecycle, state.ID) {
+			t.Errorf("state %s of the example lifecycle can not be reached", state.Name)
+		}
+	}
+
+	c := newLifecycleChain(t, lifecycle, map[string]string{
+		"m":  "manufacturer",
+		"i":  "inspector",
+		"w":  "warehouse",
+		"cu": "customs",
+		"d":  "distributor",
+		"r":  "retailer",
+		"c":  "consumer",
+	})
+	status := func(name string) TransactionStatus {
+		id, ok := lifecycle.Status(name)
+		if !ok {
+			t.Fatalf("example lifecycle has no state %s", name)
+		}
+		return id
+	}
+	transfer := func(holder, productID, state string) {
+		t.Helper()
+		c.apply(c.tx(Transfer, holder, holder, productID, status(state)))
+	}
+
+	// Inspected, warehoused, cleared by customs and dispatched through a retailer to the consumer
+	c.applyOffer("m", "i", "p", status("Manufactured"))
+	transfer("i", "p", "Inspected")
+	c.applyOffer("i", "w", "p", status("Warehoused"))
+	c.applyOffer("w", "cu", "p", status("Warehoused"))
+	c.applyOffer("cu", "d", "p", status("CustomsCleared"))
+	c.applyOffer("d", "r", "p", status("Dispatched"))
+	c.applyOffer("r", "c", "p", status("Dispatched"))
+	transfer("c", "p", "Received")
+
+	// Returned through the retailer to the warehouse, which stores it again
+	transfer("c", "p", "ReturnInitiated")
+	c.applyOffer("c", "r", "p", status("ReturnInTransit"))
+	c.applyOffer("r", "w", "p", status("ReturnInTransit"))
+	transfer("w", "p", "ReturnReceived")
+	transfer("w", "p", "Warehoused")
+
+	// Dispatched by a distributor without a customs clearance
+	c.applyOffer("w", "d", "p", status("Warehoused"))
+	c.applyOffer("d", "c", "p", status("Dispatched"))
+	if product := c.product("p"); product.Status != status("Dispatched") || product.Holder != "c" {
+		t.Errorf("product is %s held by %s", lifecycle.StateName(product.Status), product.Holder)
+	}
+
+	// Disposed by the inspector
+	c.applyOffer("m", "i", "q", status("Manufactured"))
+	transfer("i", "q", "Inspected")
+	transfer("i", "q", "Disposed")
+	if product := c.product("q"); product.Status != status("Disposed") || product.Holder != "i" {
+		t.Errorf("product is %s held by %s", lifecycle.StateName(product.Status), product.Holder)
+	}
+}
+
+// Check if a product can reach the state when each transition is performed by the holder
+func reachable(lifecycle *Lifecycle, target TransactionStatus) bool {
+	type position struct {
+		status TransactionStatus
+		role   string
+	}
+
+	// A product is created by a node with one of the roles of the creating transitions
+	var queue []position
+	for _, role := range lifecycle.Roles {
+		queue = append(queue, position{StatusNone, role})
+	}
+	seen := make(map[position]bool)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if p.status == target {
+			return true
+		}
+
+		for _, next := range lifecycle.NextStates(p.status, p.role) {
+			transition, _ := lifecycle.Transition(p.status, next)
+			if !transition.TransfersCustody {
+				queue = append(queue, position{next, p.role})
+				continue
+			}
+			for _, role := range lifecycle.Roles {
+				queue = append(queue, position{next, role})
+			}
+		}
+	}
+
+	return false
+}
+
+func TestRolesOfTheSenders(t *testing.T) {
+	c := newTestChain(t)
+
+	manufacture := c.tx(Transfer, "d1", "d1", "p", Manufactured)
+	if err := c.check(versionBefore(RuleLifecycleRoles), manufacture); err != nil {
+		t.Errorf("roles are checked before version 6: %v", err)
+	}
+	if err := c.check(RuleVersion(RuleLifecycleRoles), manufacture); !errors.Is(err, ErrRoleNotAllowed) {
+		t.Errorf("distributor manufacturing a product returned %v", err)
+	}
+
+	// From version 16 only the roles registered on the chain are used
+	claimed := map[string]string{"d1": "manufacturer"}
+	offer := c.tx(Offer, "d1", "d2", "p", Manufactured)
+	if err := c.state.CheckTransitions(versionBefore(RuleRegisteredRoles), c.state.Height+1, []*Transaction{offer}, claimed); err != nil {
+		t.Errorf("given roles are not used before version 16: %v", err)
+	}
+	if err := c.state.CheckTransitions(RuleVersion(RuleRegisteredRoles), c.state.Height+1, []*Transaction{offer}, claimed); !errors.Is(err, ErrRoleNotAllowed) {
+		t.Errorf("given role is used instead of the registered role: %v", err)
+	}
+
+	// A node that registers in the block can act in its role in the later transactions of the block
+	register := NewRegisterTransaction("x", "manufacturer", c.next("x"), "test")
+	byNewNode := c.tx(Offer, "x", "d1", "q", Manufactured)
+	if err := c.check(CurrentBlockVersion, byNewNode); !errors.Is(err, ErrRoleNotAllowed) {
+		t.Errorf("unregistered node manufacturing a product returned %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, register, byNewNode); err != nil {
+		t.Errorf("registered node manufacturing a product returned %v", err)
+	}
+	c.apply(register)
+	if role := c.state.Role("x"); role != "manufacturer" {
+		t.Errorf("registered role is %q", role)
+	}
+}
+
+func TestRolesAreRegisteredOnce(t *testing.T) {
+	c := newTestChain(t)
+
+	if err := c.check(CurrentBlockVersion, NewRegisterTransaction("d1", "manufacturer", c.next("d1"), "test")); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("registering again returned %v", err)
+	}
+
+	first := NewRegisterTransaction("x", "consumer", c.next("x"), "test")
+	second := NewRegisterTransaction("x", "manufacturer", c.next("x"), "test")
+	if err := c.check(CurrentBlockVersion, first, second); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("registering twice in a block returned %v", err)
+	}
+
+	if err := c.check(CurrentBlockVersion, NewRegisterTransaction("y", "inspector", c.next("y"), "test")); !errors.Is(err, ErrInvalidRegistration) {
+		t.Errorf("registering a role the lifecycle does not define returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleRegisteredRoles), NewRegisterTransaction("y", "consumer", c.next("y"), "test")); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("registering before version 16 returned %v", err)
+	}
+}
+
+func TestOnlyTheHolderMovesAProduct(t *testing.T) {
+	c := newTestChain(t)
+	c.applyOffer("m", "d1", "p", Manufactured)
+
+	dispatch := c.tx(Offer, "d2", "c", "p", Dispatched)
+	if err := c.check(versionBefore(RuleHolderMovesProduct), c.tx(Transfer, "d2", "c", "p", Dispatched)); err != nil {
+		t.Errorf("holder is checked before version 7: %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, dispatch); !errors.Is(err, ErrNotHolder) {
+		t.Errorf("moving a product held by another node returned %v", err)
+	}
+
+	// The product passes through any number of distributors
+	c.applyOffer("d1", "d2", "p", Dispatched)
+	c.applyOffer("d2", "c", "p", Dispatched)
+
+	product := c.product("p")
+	want := [][2]string{{"m", "d1"}, {"d1", "d2"}, {"d2", "c"}}
+	if len(product.Hops) != len(want) {
+		t.Fatalf("product has %d hops, want %d", len(product.Hops), len(want))
+	}
+	for i, hop := range product.Hops {
+		if hop.From != want[i][0] || hop.To != want[i][1] {
+			t.Errorf("hop %d is from %s to %s, want from %s to %s", i, hop.From, hop.To, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestCustodyMovesWhenTheOfferIsAccepted(t *testing.T) {
+	c := newTestChain(t)
+	c.applyOffer("m", "d1", "p", Manufactured)
+
+	if err := c.check(CurrentBlockVersion, c.tx(Transfer, "d1", "d2", "p", Dispatched)); !errors.Is(err, ErrOfferRequired) {
+		t.Errorf("transferring custody without an offer returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleCustodyOffers), c.tx(Transfer, "d1", "d2", "p", Dispatched)); err != nil {
+		t.Errorf("offers are required before version 8: %v", err)
+	}
+
+	offer := c.tx(Offer, "d1", "d2", "p", Dispatched)
+	c.apply(offer)
+	if product := c.product("p"); product.Holder != "d1" || product.Status != Manufactured || product.Offer == nil {
+		t.Fatalf("offered product is %d held by %s", product.Status, product.Holder)
+	}
+
+	if err := c.check(CurrentBlockVersion, NewOfferResponse(Accept, "c", offer, c.next("c"), "test")); !errors.Is(err, ErrNotOfferReceiver) {
+		t.Errorf("accepting the offer to another node returned %v", err)
+	}
+	other := c.tx(Offer, "d1", "d2", "q", Dispatched)
+	if err := c.check(CurrentBlockVersion, NewOfferResponse(Accept, "d2", other, c.next("d2"), "test")); !errors.Is(err, ErrNoOffer) {
+		t.Errorf("accepting an offer that was never made returned %v", err)
+	}
+
+	c.apply(NewOfferResponse(Reject, "d2", offer, c.next("d2"), "test"))
+	if product := c.product("p"); product.Holder != "d1" || product.Status != Manufactured || product.Offer != nil {
+		t.Fatalf("rejected product is %d held by %s", product.Status, product.Holder)
+	}
+
+	c.applyOffer("d1", "d2", "p", Dispatched)
+	if product := c.product("p"); product.Holder != "d2" || product.Status != Dispatched {
+		t.Fatalf("accepted product is %d held by %s", product.Status, product.Holder)
+	}
+}
+
+func TestOffersExpire(t *testing.T) {
+	c := newTestChain(t)
+
+	offer := c.tx(Offer, "m", "d1", "p", Manufactured)
+	c.apply(offer)
+	for i := uint(0); i < c.state.Lifecycle.OfferExpiry; i++ {
+		c.apply()
+	}
+
+	accept := NewOfferResponse(Accept, "d1", offer, c.next("d1"), "test")
+	if err := c.check(CurrentBlockVersion, accept); !errors.Is(err, ErrOfferExpired) {
+		t.Errorf("accepting an expired offer returned %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, NewOfferResponse(Reject, "d1", offer, c.next("d1"), "test")); err != nil {
+		t.Errorf("rejecting an expired offer returned %v", err)
+	}
+}
+
+func TestShipmentsStayOpenUntilTheNextHolderMovesTheProduct(t *testing.T) {
+	c := newTestChain(t)
+
+	offer := c.tx(Offer, "m", "d1", "p", Manufactured)
+	c.apply(offer)
+	if shipments := c.state.OpenShipments("m"); len(shipments) != 1 || shipments[0] != "p" {
+		t.Fatalf("shipments of the manufacturer are %v after the offer", shipments)
+	}
+
+	c.apply(NewOfferResponse(Accept, "d1", offer, c.next("d1"), "test"))
+	if shipments := c.state.OpenShipments("m"); len(shipments) != 1 {
+		t.Fatalf("shipment of the manufacturer is closed when the offer is accepted")
+	}
+
+	c.apply(c.tx(Offer, "d1", "c", "p", Dispatched))
+	if shipments := c.state.OpenShipments("m"); len(shipments) != 0 {
+		t.Errorf("shipments of the manufacturer are %v after the distributor moved the product", shipments)
+	}
+	if shipments := c.state.OpenShipments("d1"); len(shipments) != 1 || shipments[0] != "p" {
+		t.Errorf("shipments of the distributor are %v after its offer", shipments)
+	}
+}
+
+// Offer a new lot of products and apply the acceptance of the receiver
+func (c *testChain) applyLot(sender, receiver, lotID string, products []string) {
+	c.t.Helper()
+
+	c.nonces[sender]++
+	offer := NewLotTransaction(Offer, sender, receiver, lotID, products, Manufactured, c.nonces[sender], "test")
+	c.apply(offer)
+	c.apply(NewOfferResponse(Accept, receiver, offer, c.next(receiver), "test"))
+}
+
+func TestLots(t *testing.T) {
+	c := newTestChain(t)
+
+	c.nonces["m"]++
+	lot := NewLotTransaction(Offer, "m", "d1", "lot", []string{"p1", "p2"}, Manufactured, c.nonces["m"], "test")
+	if err := c.check(versionBefore(RuleLots), lot); !errors.Is(err, ErrInvalidLot) {
+		t.Errorf("creating a lot before version 9 returned %v", err)
+	}
+
+	c.nonces["m"]++
+	duplicate := NewLotTransaction(Offer, "m", "d1", "other", []string{"p3", "p3"}, Manufactured, c.nonces["m"], "test")
+	if err := c.check(CurrentBlockVersion, duplicate); !errors.Is(err, ErrInvalidLot) {
+		t.Errorf("creating a lot with a duplicate product returned %v", err)
+	}
+
+	c.applyLot("m", "d1", "lot", []string{"p1", "p2"})
+
+	c.nonces["m"]++
+	existing := NewLotTransaction(Offer, "m", "d1", "other", []string{"p1"}, Manufactured, c.nonces["m"], "test")
+	if err := c.check(CurrentBlockVersion, existing); !errors.Is(err, ErrInvalidLot) {
+		t.Errorf("adding an existing product to a lot returned %v", err)
+	}
+
+	// The products of the lot move with the lot and can not be moved alone
+	c.applyOffer("d1", "c", "lot", Dispatched)
+	for _, productID := range []string{"p1", "p2"} {
+		product := c.product(productID)
+		if product.Status != Dispatched || product.Holder != "c" || product.Manufacturer != "m" {
+			t.Errorf("product %s of the lot is %d held by %s manufactured by %s", productID, product.Status, product.Holder, product.Manufacturer)
+		}
+	}
+	if err := c.check(CurrentBlockVersion, c.tx(Transfer, "c", "c", "p1", Received)); !errors.Is(err, ErrProductPacked) {
+		t.Errorf("moving a product of a lot alone returned %v", err)
+	}
+}
+
+func (c *testChain) pack(kind TransactionKind, sender, containerID string, products []string, status TransactionStatus) *Transaction {
+	c.nonces[sender]++
+	return NewLotTransaction(kind, sender, sender, containerID, products, status, c.nonces[sender], "test")
+}
+
+func TestPacking(t *testing.T) {
+	c := newTestChain(t)
+	c.applyOffer("m", "d1", "p1", Manufactured)
+	c.applyOffer("m", "d1", "p2", Manufactured)
+	c.applyOffer("m", "d2", "p3", Manufactured)
+
+	if err := c.check(versionBefore(RulePacking), c.pack(Pack, "d1", "box", []string{"p1", "p2"}, Manufactured)); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("packing before version 10 returned %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, c.pack(Pack, "d1", "box", []string{"p1", "p3"}, Manufactured)); !errors.Is(err, ErrInvalidPacking) {
+		t.Errorf("packing a product held by another node returned %v", err)
+	}
+	if err := c.check(CurrentBlockVersion, c.pack(Pack, "d1", "box", []string{"p1"}, Dispatched)); !errors.Is(err, ErrInvalidPacking) {
+		t.Errorf("packing with a different status returned %v", err)
+	}
+
+	c.apply(c.pack(Pack, "d1", "box", []string{"p1", "p2"}, Manufactured))
+	if box := c.product("box"); box.Holder != "d1" || box.Manufacturer != "d1" || len(box.Products) != 2 {
+		t.Fatalf("box is held by %s manufactured by %s with %v", box.Holder, box.Manufacturer, box.Products)
+	}
+
+	// The packed products follow the box
+	c.applyOffer("d1", "c", "box", Dispatched)
+	if product := c.product("p2"); product.Status != Dispatched || product.Holder != "c" || product.Container != "box" {
+		t.Errorf("packed product is %d held by %s in %q", product.Status, product.Holder, product.Container)
+	}
+
+	c.apply(c.pack(Unpack, "c", "box", []string{"p1"}, Dispatched))
+	if product := c.product("p1"); product.Container != "" || product.Holder != "c" {
+		t.Errorf("unpacked product is held by %s in %q", product.Holder, product.Container)
+	}
+	if err := c.check(CurrentBlockVersion, c.pack(Unpack, "c", "box", []string{"p1"}, Dispatched)); !errors.Is(err, ErrInvalidPacking) {
+		t.Errorf("unpacking a product that is not packed returned %v", err)
+	}
+	c.apply(c.tx(Transfer, "c", "c", "p1", Received))
+}
+
+func (c *testChain) recall(sender, productID string) *Transaction {
+	return c.tx(Recall, sender, sender, productID, c.product(productID).Status)
+}
+
+func TestRecalls(t *testing.T) {
+	c := newTestChain(t)
+	c.applyLot("m", "d1", "lot", []string{"p1", "p2"})
+
+	if err := c.check(CurrentBlockVersion, c.recall("d1", "lot")); !errors.Is(err, ErrNotManufacturer) {
+		t.Errorf("recall by a node that did not manufacture the product returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleRecalls), c.recall("m", "lot")); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("recall before version 11 returned %v", err)
+	}
+
+	c.apply(c.recall("m", "lot"))
+	for _, productID := range []string{"lot", "p1", "p2"} {
+		if recall := c.product(productID).Recall; recall == nil || recall.ProductID != "lot" || recall.Manufacturer != "m" {
+			t.Errorf("recall of product %s is %+v", productID, recall)
+		}
+	}
+	if err := c.check(CurrentBlockVersion, c.recall("m", "p1")); !errors.Is(err, ErrAlreadyRecalled) {
+		t.Errorf("recalling a recalled product returned %v", err)
+	}
+}
+
+func TestRecallOfAContainerWithProductsOfAnotherManufacturer(t *testing.T) {
+	c := newTestChain(t)
+	c.applyOffer("m", "d1", "p", Manufactured)
+
+	// The distributor packs the product of the manufacturer in a pallet which it manufactures itself
+	c.apply(c.pack(Pack, "d1", "pallet", []string{"p"}, Manufactured))
+	if err := c.check(CurrentBlockVersion, c.recall("d1", "pallet")); !errors.Is(err, ErrNotManufacturer) {
+		t.Errorf("recalling a pallet with a product of another manufacturer returned %v", err)
+	}
+	if err := c.check(versionBefore(RuleRecallOwnProducts), c.recall("d1", "pallet")); err != nil {
+		t.Errorf("contents of a recall are checked before version 17: %v", err)
+	}
+
+	// Also in a nested container and when the product is packed in the same block
+	c.applyOffer("m", "d1", "q", Manufactured)
+	pack := c.pack(Pack, "d1", "box", []string{"q"}, Manufactured)
+	nest := c.pack(Pack, "d1", "crate", []string{"box"}, Manufactured)
+	if err := c.check(CurrentBlockVersion, pack, nest, c.tx(Recall, "d1", "d1", "crate", Manufactured)); !errors.Is(err, ErrNotManufacturer) {
+		t.Errorf("recalling a crate with a nested product of another manufacturer returned %v", err)
+	}
+
+	// The manufacturer can still recall its product while it is packed
+	c.apply(c.recall("m", "p"))
+	if c.product("p").Recall == nil || c.product("pallet").Recall != nil {
+		t.Error("recall of a packed product did not only recall the product")
+	}
+}
+
+func TestReturns(t *testing.T) {
+	c := newTestChain(t)
+	c.deliver("p")
+
+	initiate := c.tx(Transfer, "c", "c", "p", ReturnInitiated)
+	c.apply(initiate)
+	c.applyOffer("c", "d1", "p", ReturnInTransit)
+	if product := c.product("p"); product.Return == nil || product.Return.Consumer != "c" || product.Return.Refunded {
+		t.Fatalf("return of the product in transit is %+v", product.Return)
+	}
+
+	c.apply(c.tx(Transfer, "d1", "d1", "p", ReturnReceived))
+	product := c.product("p")
+	if product.Return == nil || !product.Return.Refunded || product.Return.RefundHeight != c.state.Height {
+		t.Fatalf("received return is %+v", product.Return)
+	}
+	if string(product.Return.TxID) != string(initiate.ID) {
+		t.Error("return is not identified by the transaction that started it")
+	}
+	if product.Holder != "d1" {
+		t.Errorf("returned product is held by %s", product.Holder)
+	}
+}
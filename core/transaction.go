@@ -6,6 +6,8 @@ import (
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/Animesh-03/scms/logger"
 )
@@ -16,24 +18,231 @@ const (
 	Manufactured TransactionStatus = 1
 	Dispatched   TransactionStatus = 2
 	Received     TransactionStatus = 3
+	// States of a product returned by the consumer
+	ReturnInitiated TransactionStatus = 4
+	ReturnInTransit TransactionStatus = 5
+	ReturnReceived  TransactionStatus = 6
+)
+
+type TransactionKind uint8
+
+const (
+	// Moves the product to the status of the transaction
+	Transfer TransactionKind = 0
+	// Offers to transfer the product to the receiver, the product is moved when the receiver accepts the offer
+	Offer TransactionKind = 1
+	// Accepts the offer of the receiver of the transaction
+	Accept TransactionKind = 2
+	// Rejects the offer of the receiver of the transaction
+	Reject TransactionKind = 3
+	// Packs the products of the transaction in the product of the transaction
+	Pack TransactionKind = 4
+	// Unpacks the products of the transaction from the product of the transaction
+	Unpack TransactionKind = 5
+	// Recalls the product of the transaction and all the products packed in it
+	Recall TransactionKind = 6
+	// Stakes the amount of the transaction for the sender, replacing its earlier stake
+	Stake TransactionKind = 7
+	// Votes for the candidates of the transaction as verifiers, replacing the earlier vote of the sender.
+	// A vote without candidates withdraws the earlier vote. Before version 7 the receiver is the only candidate.
+	Vote TransactionKind = 8
+	// Registers the role of the sender in the product lifecycle, the role of a node can only be registered once
+	Register TransactionKind = 9
+)
+
+// Versions of the transaction format
+const (
+	// Transactions whose fields are concatenated without length prefixes
+	TransactionVersion1 uint32 = 1
+	// Transactions in the canonical binary encoding
+	TransactionVersion2 uint32 = 2
+	// Transactions with a nonce, creation timestamp and chain ID for replay protection
+	TransactionVersion3 uint32 = 3
+	// Transactions with a kind which are part of a two phase handoff
+	TransactionVersion4 uint32 = 4
+	// Transactions which can create a lot of products
+	TransactionVersion5 uint32 = 5
+	// Transactions with an amount which can stake tokens
+	TransactionVersion6 uint32 = 6
+	// Transactions which can vote for any number of candidates
+	TransactionVersion7 uint32 = 7
+	// Transactions with a role which can register the role of the sender
+	TransactionVersion8 uint32 = 8
+
+	CurrentTransactionVersion = TransactionVersion8
+)
+
+const (
+	// Maximum age of a transaction when it is added to the mempool or to a block
+	MaxTransactionAge = time.Hour
+	// Maximum time a transaction may be created ahead of the clock of the verifying node or block
+	MaxClockDrift = time.Minute
+)
+
+var (
+	ErrChainIDMismatch = errors.New("transaction is for a different chain")
+	ErrStaleNonce      = errors.New("transaction nonce is already used")
+	ErrStaleTimestamp  = errors.New("transaction is too old")
+	ErrFutureTimestamp = errors.New("transaction is created in the future")
+	ErrNoReplayGuard   = errors.New("transaction has no replay protection")
 )
 
 type Transaction struct {
+	// Transactions created before the version was introduced have version 0 and are treated as version 1
+	Version   uint32            `json:"version"`
 	ID        []byte            `json:"id"`
 	Sender    string            `json:"sender"`
 	Receiver  string            `json:"receiver"`
 	ProductID string            `json:"productid"`
 	Status    TransactionStatus `json:"status"`
-	Signature []byte            `json:"signature"`
+	// Replay protection: the nonce must be greater than any nonce previously used by the sender
+	Nonce     uint64          `json:"nonce"`
+	Timestamp int64           `json:"timestamp"`
+	ChainID   string          `json:"chainid"`
+	Kind      TransactionKind `json:"kind"`
+	// ID of the offer that is accepted or rejected
+	OfferID []byte `json:"offerid"`
+	// Products of the lot with the ID of the product of the transaction that is created by it
+	Products []string `json:"products,omitempty"`
+	// Amount of tokens staked by the transaction
+	Amount uint64 `json:"amount,omitempty"`
+	// Candidates voted for by the transaction
+	Candidates []string `json:"candidates,omitempty"`
+	// Role registered by the transaction
+	Role      string `json:"role,omitempty"`
+	Signature []byte `json:"signature"`
 }
 
+// Payload of the transaction which is hashed to compute its ID
 func (t *Transaction) Bytes() []byte {
-	return bytes.Join([][]byte{
-		[]byte(t.Sender),
-		[]byte(t.Receiver),
-		[]byte(t.ProductID),
-		ToByte(int64(t.Status)),
-	}, []byte{})
+	if t.Version < TransactionVersion2 {
+		return bytes.Join([][]byte{
+			[]byte(t.Sender),
+			[]byte(t.Receiver),
+			[]byte(t.ProductID),
+			ToByte(int64(t.Status)),
+		}, []byte{})
+	}
+
+	enc := NewEncoder()
+	enc.WriteUint(uint64(t.Version))
+	enc.WriteString(t.Sender)
+	enc.WriteString(t.Receiver)
+	enc.WriteString(t.ProductID)
+	enc.WriteUint(uint64(t.Status))
+	if t.Version >= TransactionVersion3 {
+		enc.WriteUint(t.Nonce)
+		enc.WriteInt(t.Timestamp)
+		enc.WriteString(t.ChainID)
+	}
+	if t.Version >= TransactionVersion4 {
+		enc.WriteUint(uint64(t.Kind))
+		enc.WriteBytes(t.OfferID)
+	}
+	if t.Version >= TransactionVersion5 {
+		enc.WriteStrings(t.Products)
+	}
+	if t.Version >= TransactionVersion6 {
+		enc.WriteUint(t.Amount)
+	}
+	if t.Version >= TransactionVersion7 {
+		enc.WriteStrings(t.Candidates)
+	}
+	if t.Version >= TransactionVersion8 {
+		enc.WriteString(t.Role)
+	}
+	return enc.Bytes()
+}
+
+// Data signed by the sender of the transaction.
+// Version 1 signs the payload directly, which ECDSA truncates to the size of the curve,
+// so from version 2 the hash of the payload is signed instead.
+func (t *Transaction) SigningDigest() []byte {
+	if t.Version < TransactionVersion2 {
+		return t.Bytes()
+	}
+
+	return t.Hash()
+}
+
+// Encode the complete transaction for gossip and storage
+func (t *Transaction) Encode() []byte {
+	enc := NewEncoder()
+	t.encode(enc)
+	return enc.Bytes()
+}
+
+func (t *Transaction) encode(enc *Encoder) {
+	enc.WriteUint(uint64(t.Version))
+	enc.WriteBytes(t.ID)
+	enc.WriteString(t.Sender)
+	enc.WriteString(t.Receiver)
+	enc.WriteString(t.ProductID)
+	enc.WriteUint(uint64(t.Status))
+	enc.WriteUint(t.Nonce)
+	enc.WriteInt(t.Timestamp)
+	enc.WriteString(t.ChainID)
+	if t.Version >= TransactionVersion4 {
+		enc.WriteUint(uint64(t.Kind))
+		enc.WriteBytes(t.OfferID)
+	}
+	if t.Version >= TransactionVersion5 {
+		enc.WriteStrings(t.Products)
+	}
+	if t.Version >= TransactionVersion6 {
+		enc.WriteUint(t.Amount)
+	}
+	if t.Version >= TransactionVersion7 {
+		enc.WriteStrings(t.Candidates)
+	}
+	if t.Version >= TransactionVersion8 {
+		enc.WriteString(t.Role)
+	}
+	enc.WriteBytes(t.Signature)
+}
+
+// Decode a transaction encoded with Encode
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	dec := NewDecoder(data)
+	tx := decodeTransaction(dec)
+	if err := dec.Finish(); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func decodeTransaction(dec *Decoder) *Transaction {
+	tx := &Transaction{
+		Version:   uint32(dec.ReadUint()),
+		ID:        dec.ReadBytes(),
+		Sender:    dec.ReadString(),
+		Receiver:  dec.ReadString(),
+		ProductID: dec.ReadString(),
+		Status:    TransactionStatus(dec.ReadUint()),
+		Nonce:     dec.ReadUint(),
+		Timestamp: dec.ReadInt(),
+		ChainID:   dec.ReadString(),
+	}
+	if tx.Version >= TransactionVersion4 {
+		tx.Kind = TransactionKind(dec.ReadUint())
+		tx.OfferID = dec.ReadBytes()
+	}
+	if tx.Version >= TransactionVersion5 {
+		tx.Products = dec.ReadStrings()
+	}
+	if tx.Version >= TransactionVersion6 {
+		tx.Amount = dec.ReadUint()
+	}
+	if tx.Version >= TransactionVersion7 {
+		tx.Candidates = dec.ReadStrings()
+	}
+	if tx.Version >= TransactionVersion8 {
+		tx.Role = dec.ReadString()
+	}
+	tx.Signature = dec.ReadBytes()
+
+	return tx
 }
 
 func (t *Transaction) Stringify() string {
@@ -49,12 +258,83 @@ func (t *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func NewTransaction(sender, receiver, productId string, status TransactionStatus) *Transaction {
+func NewTransaction(kind TransactionKind, sender, receiver, productId string, status TransactionStatus, nonce uint64, chainID string) *Transaction {
 	transaction := &Transaction{
+		Version:   CurrentTransactionVersion,
+		Kind:      kind,
 		Sender:    sender,
 		Receiver:  receiver,
 		ProductID: productId,
 		Status:    status,
+		Nonce:     nonce,
+		Timestamp: time.Now().UnixMilli(),
+		ChainID:   chainID,
+	}
+
+	transaction.ID = transaction.Hash()
+
+	return transaction
+}
+
+// Create a transaction which creates the lot with the given ID containing the products
+func NewLotTransaction(kind TransactionKind, sender, receiver, lotId string, products []string, status TransactionStatus, nonce uint64, chainID string) *Transaction {
+	transaction := NewTransaction(kind, sender, receiver, lotId, status, nonce, chainID)
+	transaction.Products = products
+	transaction.ID = transaction.Hash()
+
+	return transaction
+}
+
+// Create a transaction which stakes the amount for the sender
+func NewStakeTransaction(sender string, amount uint64, nonce uint64, chainID string) *Transaction {
+	transaction := NewTransaction(Stake, sender, sender, "", StatusNone, nonce, chainID)
+	transaction.Amount = amount
+	transaction.ID = transaction.Hash()
+
+	return transaction
+}
+
+// Create a transaction which votes for the candidates, or withdraws the vote of the sender if there are none
+func NewVoteTransaction(sender string, candidates []string, nonce uint64, chainID string) *Transaction {
+	transaction := NewTransaction(Vote, sender, sender, "", StatusNone, nonce, chainID)
+	transaction.Candidates = candidates
+	transaction.ID = transaction.Hash()
+
+	return transaction
+}
+
+// Create a transaction which registers the role of the sender in the product lifecycle
+func NewRegisterTransaction(sender string, role string, nonce uint64, chainID string) *Transaction {
+	transaction := NewTransaction(Register, sender, sender, "", StatusNone, nonce, chainID)
+	transaction.Role = role
+	transaction.ID = transaction.Hash()
+
+	return transaction
+}
+
+// Get the candidates voted for by the transaction
+func (t *Transaction) VotedCandidates() []string {
+	if t.Version < TransactionVersion7 {
+		return []string{t.Receiver}
+	}
+
+	return t.Candidates
+}
+
+// Create a transaction which accepts or rejects the offer.
+// The transaction is sent back to the sender of the offer for the same product and status.
+func NewOfferResponse(kind TransactionKind, sender string, offer *Transaction, nonce uint64, chainID string) *Transaction {
+	transaction := &Transaction{
+		Version:   CurrentTransactionVersion,
+		Kind:      kind,
+		Sender:    sender,
+		Receiver:  offer.Sender,
+		ProductID: offer.ProductID,
+		Status:    offer.Status,
+		Nonce:     nonce,
+		Timestamp: time.Now().UnixMilli(),
+		ChainID:   chainID,
+		OfferID:   offer.ID,
 	}
 
 	transaction.ID = transaction.Hash()
@@ -63,17 +343,47 @@ func NewTransaction(sender, receiver, productId string, status TransactionStatus
 }
 
 func (t *Transaction) Verify(pubKey ecdsa.PublicKey) bool {
+	if t.Version > CurrentTransactionVersion {
+		return false
+	}
+
 	if len(t.ID) == 0 || !bytes.Equal(t.Hash(), t.ID) {
 		return false
 	}
 
+	// The key of a sender that is not registered is empty and can not be used to verify
+	if pubKey.X == nil || pubKey.Y == nil {
+		return false
+	}
 	pubKey.Curve = elliptic.P256()
 
 	logger.LogWarn("PubKey: %+v\n", pubKey)
 
-	if v := ecdsa.VerifyASN1(&pubKey, t.Bytes(), t.Signature); !v {
+	if v := ecdsa.VerifyASN1(&pubKey, t.SigningDigest(), t.Signature); !v {
 		return false
 	}
 
 	return true
 }
+
+// Check that the transaction is meant for the chain and was created within the allowed
+// window around the given time in milliseconds
+func (t *Transaction) CheckReplayGuard(chainID string, now int64) error {
+	if t.Version < TransactionVersion3 {
+		return ErrNoReplayGuard
+	}
+
+	if t.ChainID != chainID {
+		return ErrChainIDMismatch
+	}
+
+	if t.Timestamp < now-MaxTransactionAge.Milliseconds() {
+		return ErrStaleTimestamp
+	}
+
+	if t.Timestamp > now+MaxClockDrift.Milliseconds() {
+		return ErrFutureTimestamp
+	}
+
+	return nil
+}
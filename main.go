@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"strings"
 
+	"github.com/Animesh-03/scms/core"
+	"github.com/Animesh-03/scms/logger"
 	"github.com/Animesh-03/scms/node"
 	"github.com/Animesh-03/scms/p2p"
 )
@@ -13,6 +16,18 @@ func main() {
 	port := flag.Uint("p", 3000, "Port to be used to run the node")
 	discoveryTag := flag.String("t", "mdns-discovery-tag", "Discovery tag")
 	nodeType := flag.Uint("n", 3, "Enter the following: Manufacturer - 1, Distributor - 2, Consumer - 3\n Default is Consumer")
+	dataDir := flag.String("d", "data", "Directory where the blockchain is stored")
+	chainID := flag.String("c", "scms", "ID of the chain, transactions of other chains are rejected")
+	lifecyclePath := flag.String("l", "", "Path of the JSON file defining the product lifecycle\n Default is Manufactured -> Dispatched -> Received")
+	role := flag.String("r", "", "Role of the node in the product lifecycle\n Default is the role of the node type")
+	maxShipments := flag.Uint("s", 0, "Maximum number of open shipments of the node\n Default is no limit")
+	epochLength := flag.Uint("e", core.DefaultEpochLength, "Number of blocks of an epoch after which the verifiers are elected again")
+	verifierCount := flag.Int("v", core.DefaultVerifierCount, "Number of verifiers elected for an epoch")
+	slotDuration := flag.Duration("b", node.DefaultSlotDuration, "Length of the time slots in which the verifiers take turns to propose blocks")
+	threshold := flag.String("q", "2/3", "Share of the verifiers whose approvals must be exceeded to commit a block")
+	weighByStake := flag.Bool("stakeweighted", false, "Weigh the approvals of the verifiers by their stake instead of counting them")
+	bootstrap := flag.String("bootstrap", "3000,3001,3002", "Comma separated IDs of the verifiers until the first epoch ends")
+	viewTimeout := flag.Duration("timeout", 0, "Time without a new block after which the next verifier proposes it\n Default is two slots")
 
 	flag.Parse()
 
@@ -23,8 +38,49 @@ func main() {
 		DiscoveryServiceTag: *discoveryTag,
 	}
 
+	quorumThreshold, err := core.ParseThreshold(*threshold)
+	if err != nil {
+		logger.LogError("Error parsing threshold: %s\n", err.Error())
+		return
+	}
+
+	var lifecycle *core.Lifecycle
+	if *lifecyclePath != "" {
+		lifecycle, err = core.LoadLifecycle(*lifecyclePath)
+		if err != nil {
+			logger.LogError("Error loading lifecycle: %s\n", err.Error())
+			return
+		}
+	}
+
 	node := &node.Node{
-		Type: node.NodeType(*nodeType),
+		Type:         node.NodeType(*nodeType),
+		DataDir:      *dataDir,
+		ChainID:      *chainID,
+		Role:         *role,
+		Lifecycle:    lifecycle,
+		MaxShipments: *maxShipments,
+		SlotDuration: *slotDuration,
+		ViewTimeout:  *viewTimeout,
+		Election: core.Election{
+			EpochLength:  *epochLength,
+			Verifiers:    *verifierCount,
+			Threshold:    quorumThreshold,
+			WeighByStake: *weighByStake,
+			Bootstrap:    splitIDs(*bootstrap),
+		},
 	}
 	node.Start(&cfg)
 }
+
+// Split a comma separated list of node IDs, ignoring empty entries
+func splitIDs(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
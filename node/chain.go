@@ -0,0 +1,251 @@
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Animesh-03/scms/core"
+	"github.com/Animesh-03/scms/logger"
+)
+
+const (
+	// Number of blocks below the tip for which side chain blocks are kept
+	MaxReorgDepth = 100
+	// Number of blocks above the tip up to which orphan blocks are kept
+	MaxOrphanDistance = 100
+	// Maximum number of blocks in the side chain pool
+	MaxSideChainBlocks = 1000
+)
+
+var (
+	ErrDuplicateBlock = errors.New("block already known")
+	ErrOrphanBlock    = errors.New("parent of block is unknown")
+	ErrInvalidBlock   = errors.New("invalid block")
+	ErrSideChainFull  = errors.New("side chain pool is full")
+)
+
+// Get the state of the chain up to the tip
+func (node *Node) State() *core.State {
+	node.stateMu.RLock()
+	defer node.stateMu.RUnlock()
+
+	return node.state
+}
+
+func (node *Node) setState(state *core.State) {
+	node.stateMu.Lock()
+	defer node.stateMu.Unlock()
+
+	node.state = state
+}
+
+// Recompute the state by applying all the blocks of the chain
+func (node *Node) RebuildState() error {
+	state, err := node.stateAt(node.Blockchain.Tip().Height)
+	if err != nil {
+		return err
+	}
+
+	node.setState(state)
+	node.UpdateVerifiers()
+	return nil
+}
+
+// Compute the state of the chain up to the block at the given height
+func (node *Node) stateAt(height uint) (*core.State, error) {
+	state := core.NewState(node.ChainID, node.Lifecycle, node.Election)
+	for h := uint(1); h <= height; h++ {
+		block, err := node.Blockchain.GetByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		state.Apply(block)
+	}
+
+	return state, nil
+}
+
+// Check if the block is part of the main chain or the side chain pool
+func (node *Node) HasBlock(hash []byte) bool {
+	if _, err := node.Blockchain.GetByHash(hash); err == nil {
+		return true
+	}
+
+	_, ok := node.SideChain.Get(hash)
+	return ok
+}
+
+// Add a block received from the network to the blockchain
+// 1. Check the hash and the signature of the proposer of the block and the signatures of its approvals
+// 2. Add the block to the side chain pool
+// 3. Find the most preferred tip among the block and the pooled blocks that extend it
+// 4. If that tip is preferred over the current tip then switch the main chain to its branch
+func (node *Node) AddBlockToBlockChain(block *core.Block) error {
+	node.chainMu.Lock()
+	defer node.chainMu.Unlock()
+
+	if node.HasBlock(block.Hash) {
+		return ErrDuplicateBlock
+	}
+
+	// Only blocks signed by a registered node are stored before they can be fully verified.
+	// The approvals are verified as well since the fork choice counts them.
+	pubKeys := node.PublicKeys()
+	if !block.VerifySignature(pubKeys) || block.Certificate == nil || !block.Certificate.VerifySignatures(block.Hash, pubKeys) {
+		return ErrInvalidBlock
+	}
+
+	// Blocks far above the tip are not stored, they are downloaded again by the sync
+	if block.Height > node.Blockchain.Tip().Height+MaxOrphanDistance {
+		return ErrOrphanBlock
+	}
+	if node.SideChain.Size() >= MaxSideChainBlocks {
+		return ErrSideChainFull
+	}
+
+	node.SideChain.Add(block)
+
+	best := node.SideChain.BestDescendant(block)
+	if !core.IsPreferredTip(best, node.Blockchain.Tip()) {
+		logger.LogInfo("Stored block %d in side chain\n", block.Height)
+		return nil
+	}
+
+	return node.reorganize(best)
+}
+
+// Make the branch ending at the given tip the main chain.
+// A branch that extends the tip is appended up to its first invalid block. A branch that forks off below the tip
+// is verified against the state at the fork point before the main chain is changed, so an invalid branch never
+// rolls back committed blocks. The blocks of the main chain above the fork point are then moved into the side
+// chain pool and their transactions which are not part of the new branch are returned to the mempool.
+func (node *Node) reorganize(tip *core.Block) error {
+	// Walk back from the tip until the branch meets the main chain
+	branch := []*core.Block{tip}
+	var ancestor *core.Block
+	for {
+		parentHash := branch[0].PreviousBlockHash
+		if parent, err := node.Blockchain.GetByHash(parentHash); err == nil {
+			ancestor = parent
+			break
+		}
+
+		parent, ok := node.SideChain.Get(parentHash)
+		if !ok {
+			return ErrOrphanBlock
+		}
+		branch = append([]*core.Block{parent}, branch...)
+	}
+
+	if ancestor.Height == node.Blockchain.Tip().Height {
+		return node.extendChain(branch)
+	}
+	return node.switchBranch(ancestor, branch)
+}
+
+// Append the blocks of a branch which extends the tip until a block is invalid
+func (node *Node) extendChain(branch []*core.Block) error {
+	var refunds []*core.ProductState
+	for i, block := range branch {
+		err := ErrInvalidBlock
+		if node.VerifyBlock(block) && node.VerifyCertificate(block, node.State()) {
+			err = node.Blockchain.Append(block)
+		}
+		if err != nil {
+			logger.LogWarn("Rejecting block %d of branch: %s\n", block.Height, err)
+			node.SideChain.RemoveWithDescendants(block)
+			node.commitBranch(branch[:i], nil, refunds)
+			return err
+		}
+
+		node.State().Apply(block)
+		refunds = append(refunds, node.Refunds(node.State(), block)...)
+		node.UpdateVerifiers()
+	}
+
+	node.commitBranch(branch, nil, refunds)
+	return nil
+}
+
+// Replace the blocks of the main chain above the ancestor with the branch if every block of the branch is valid
+func (node *Node) switchBranch(ancestor *core.Block, branch []*core.Block) error {
+	state, err := node.stateAt(ancestor.Height)
+	if err != nil {
+		return err
+	}
+
+	var refunds []*core.ProductState
+	prevBlock := ancestor
+	for _, block := range branch {
+		if !node.verifyBlockAt(block, prevBlock, state) || !node.VerifyCertificate(block, state) {
+			logger.LogWarn("Rejecting branch at block %d: %s\n", block.Height, ErrInvalidBlock)
+			node.SideChain.RemoveWithDescendants(block)
+			return ErrInvalidBlock
+		}
+
+		state.Apply(block)
+		refunds = append(refunds, node.Refunds(state, block)...)
+		prevBlock = block
+	}
+
+	removed, err := node.Blockchain.Truncate(ancestor.Height)
+	if err != nil {
+		return err
+	}
+	for _, block := range branch {
+		if err := node.Blockchain.Append(block); err != nil {
+			// The chain up to the ancestor is still valid and the missing blocks are synced again
+			if rebuildErr := node.RebuildState(); rebuildErr != nil {
+				return rebuildErr
+			}
+			return err
+		}
+	}
+
+	node.setState(state)
+	node.UpdateVerifiers()
+	node.commitBranch(branch, removed, refunds)
+	logger.LogWarn("Reorganized chain at height %d: rolled back %d blocks and applied %d blocks\n", ancestor.Height, len(removed), len(branch))
+
+	return nil
+}
+
+// Move the blocks rolled back from the main chain into the side chain pool and update
+// the mempool once the blocks of the branch are part of the main chain
+func (node *Node) commitBranch(branch []*core.Block, removed []*core.Block, refunds []*core.ProductState) {
+	if len(branch) > 0 {
+		node.setTipAdded(node.Blockchain.Tip(), time.Now().UnixMilli())
+	}
+
+	// The refunds are only notified once the whole branch is part of the main chain
+	node.NotifyRefunds(refunds)
+
+	// Replay the transactions that were dropped from the abandoned branch
+	included := make(map[string]bool)
+	for _, block := range branch {
+		node.SideChain.Remove(block)
+		node.MemPool.RemoveAll(block.Transactions)
+		for _, tx := range block.Transactions {
+			included[hex.EncodeToString(tx.ID)] = true
+		}
+	}
+	for _, block := range removed {
+		node.SideChain.Add(block)
+		for _, tx := range block.Transactions {
+			if !included[hex.EncodeToString(tx.ID)] {
+				node.MemPool.AddToPool(tx)
+			}
+		}
+	}
+
+	// Drop the transactions that can no longer be included in a block
+	now := time.Now().UnixMilli()
+	node.MemPool.RemoveIf(func(tx *core.Transaction) bool {
+		return node.State().CheckReplay(tx, now) != nil
+	})
+
+	if height := node.Blockchain.Tip().Height; height > MaxReorgDepth {
+		node.SideChain.Prune(height - MaxReorgDepth)
+	}
+}
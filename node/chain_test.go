@@ -0,0 +1,285 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Animesh-03/scms/core"
+)
+
+// Block store which counts the blocks truncated from the chain
+type countingStore struct {
+	core.BlockStore
+	truncates int
+}
+
+func (s *countingStore) Truncate(height uint) ([]*core.Block, error) {
+	s.truncates++
+	return s.BlockStore.Truncate(height)
+}
+
+// Node with the bootstrap verifiers a, b, c and d and the registered node x which is not a verifier
+type testNode struct {
+	t     *testing.T
+	node  *Node
+	store *countingStore
+	keys  map[string]*ecdsa.PrivateKey
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+
+	election := core.DefaultElection()
+	election.Bootstrap = []string{"a", "b", "c", "d"}
+	node := &Node{
+		ID:        "test",
+		DataDir:   t.TempDir(),
+		ChainID:   "test",
+		Lifecycle: core.DefaultLifecycle(),
+		Election:  election,
+		SideChain: core.NewBlockPool(),
+		MemPool:   core.NewMemPool(),
+		Dpos:      NewDposClient(),
+		PubKeyMap: make(map[string]ecdsa.PublicKey),
+		RoleMap:   make(map[string]string),
+	}
+	if err := node.OpenBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Blockchain.Close() })
+
+	store := &countingStore{BlockStore: node.Blockchain}
+	node.Blockchain = store
+
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for _, id := range []string{"a", "b", "c", "d", "x"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = key
+		node.learnRegistration(RegistrationData{PeerId: id, PublicKey: key.PublicKey, Role: "distributor"})
+	}
+
+	return &testNode{t: t, node: node, store: store, keys: keys}
+}
+
+// Create a block above the previous block signed by its scheduled proposer and approved by the approvers.
+// The salt changes the timestamp so that blocks at the same height have different hashes.
+func (n *testNode) block(prevBlock *core.Block, salt int64, approvers ...string) *core.Block {
+	n.t.Helper()
+
+	height := prevBlock.Height + 1
+	proposer := proposerFor(n.node.Election.Bootstrap, core.CurrentBlockVersion, height, 0)
+	block := core.NewBlock([]*core.Transaction{}, prevBlock.Hash, height, 0, proposer)
+	block.Timestamp = prevBlock.Timestamp + 1 + salt
+	n.sign(block, approvers...)
+
+	return block
+}
+
+// Hash the block and sign it by its proposer and the approvers
+func (n *testNode) sign(block *core.Block, approvers ...string) {
+	n.t.Helper()
+
+	block.Hash = block.ComputeHash()
+
+	var err error
+	if block.Signature, err = ecdsa.SignASN1(rand.Reader, n.keys[block.Proposer], block.Hash); err != nil {
+		n.t.Fatal(err)
+	}
+
+	approvals := make([]core.Approval, 0, len(approvers))
+	for _, id := range approvers {
+		signature, err := ecdsa.SignASN1(rand.Reader, n.keys[id], core.ApprovalDigest(block.Hash))
+		if err != nil {
+			n.t.Fatal(err)
+		}
+		approvals = append(approvals, core.Approval{Verifier: id, BlockHash: block.Hash, Signature: signature})
+	}
+	block.Certificate = core.NewQuorumCertificate(block.Hash, approvals)
+}
+
+func (n *testNode) add(block *core.Block) error {
+	return n.node.AddBlockToBlockChain(block)
+}
+
+// Append blocks approved by every verifier above the genesis block
+func (n *testNode) extend(count int) []*core.Block {
+	n.t.Helper()
+
+	blocks := []*core.Block{n.node.Blockchain.Tip()}
+	for i := 0; i < count; i++ {
+		block := n.block(blocks[len(blocks)-1], 0, "a", "b", "c", "d")
+		if err := n.add(block); err != nil {
+			n.t.Fatalf("block %d: %s", block.Height, err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+func (n *testNode) tip() *core.Block {
+	return n.node.Blockchain.Tip()
+}
+
+func TestInvalidBranchDoesNotTouchTheChain(t *testing.T) {
+	n := newTestNode(t)
+	chain := n.extend(2)
+	tip := n.tip()
+
+	// Approvals that are not signed by the verifiers are never pooled
+	forged := n.block(chain[1], 1, "a", "b", "c", "d")
+	forged.Certificate.Approvals[0].Signature = forged.Certificate.Approvals[1].Signature
+	if err := n.add(forged); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("block with forged approvals returned %v", err)
+	}
+	if err := n.add(n.block(chain[1], 1, "a", "a", "b", "c", "d")); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("block with duplicate approvals returned %v", err)
+	}
+
+	// The approvals of a registered node that is not a verifier win the fork choice but are not a quorum
+	invalid := n.block(chain[1], 2, "a", "b", "c", "d", "x")
+	if err := n.add(invalid); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("branch with the approval of a node which is not a verifier returned %v", err)
+	}
+
+	if n.tip() != tip || n.store.truncates != 0 {
+		t.Errorf("invalid branch truncated the chain %d times and moved the tip to %d", n.store.truncates, n.tip().Height)
+	}
+	if n.node.HasBlock(invalid.Hash) || n.node.HasBlock(forged.Hash) {
+		t.Error("invalid block was kept in the side chain pool")
+	}
+	if n.node.State().Height != tip.Height {
+		t.Errorf("state is at height %d", n.node.State().Height)
+	}
+}
+
+func TestLongerValidBranchIsAdopted(t *testing.T) {
+	n := newTestNode(t)
+	chain := n.extend(2)
+
+	// A fork with fewer approvals than the tip is only stored
+	fork := n.block(chain[1], 1, "a", "b", "c")
+	if err := n.add(fork); err != nil {
+		t.Fatal(err)
+	}
+	if n.tip() != chain[2] || n.store.truncates != 0 {
+		t.Fatal("fork with fewer approvals replaced the tip")
+	}
+
+	next := n.block(fork, 0, "a", "b", "c")
+	if err := n.add(next); err != nil {
+		t.Fatal(err)
+	}
+	if n.tip() != next || n.store.truncates != 1 {
+		t.Fatalf("longer branch was not adopted, tip is at height %d", n.tip().Height)
+	}
+	if n.node.State().Height != next.Height {
+		t.Errorf("state is at height %d", n.node.State().Height)
+	}
+	if !n.node.HasBlock(chain[2].Hash) {
+		t.Error("abandoned block was not moved into the side chain pool")
+	}
+	if n.node.SideChain.Size() != 1 {
+		t.Errorf("side chain pool holds %d blocks", n.node.SideChain.Size())
+	}
+}
+
+func TestTiesGoToTheMostApprovalsAndThenTheLowestHash(t *testing.T) {
+	n := newTestNode(t)
+	chain := n.extend(1)
+
+	first, second := n.block(chain[1], 0, "a", "b", "c"), n.block(chain[1], 1, "a", "b", "c")
+	if string(first.Hash) > string(second.Hash) {
+		first, second = second, first
+	}
+
+	// The block with the lowest hash wins whichever block arrives first
+	if err := n.add(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.add(first); err != nil {
+		t.Fatal(err)
+	}
+	if n.tip() != first {
+		t.Fatal("tip is not the block with the lowest hash")
+	}
+
+	// More approvals win over a lower hash
+	approved := n.block(chain[1], 2, "a", "b", "c", "d")
+	if err := n.add(approved); err != nil {
+		t.Fatal(err)
+	}
+	if n.tip() != approved {
+		t.Error("block with more approvals did not become the tip")
+	}
+}
+
+func TestStateCanBeReadDuringAReorganization(t *testing.T) {
+	n := newTestNode(t)
+	chain := n.extend(2)
+	fork := n.block(chain[1], 1, "a", "b", "c")
+	next := n.block(fork, 0, "a", "b", "c")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = n.node.State().CurrentEpoch()
+			_ = n.node.Info()
+		}
+	}()
+
+	if err := n.add(fork); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.add(next); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if n.node.State().Height != next.Height {
+		t.Errorf("state is at height %d", n.node.State().Height)
+	}
+}
+
+func TestViewsAreCountedFromTheTimeTheTipWasAdded(t *testing.T) {
+	n := newTestNode(t)
+	timeout := DefaultSlotDuration
+
+	// Above the genesis block the view follows the clock
+	now := time.Now().UnixMilli()
+	if added := n.node.tipAddedAt(n.tip(), now); added != 0 {
+		t.Errorf("genesis block was added at %d, want 0", added)
+	}
+
+	// A timestamp ahead of the clock does not delay the view change
+	block := n.block(n.tip(), 0, "a", "b", "c", "d")
+	block.Timestamp = time.Now().Add(core.MaxClockDrift / 2).UnixMilli()
+	n.sign(block, "a", "b", "c", "d")
+	before := time.Now().UnixMilli()
+	if err := n.add(block); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixMilli()
+
+	added := n.node.tipAddedAt(n.tip(), after)
+	if added < before || added > after {
+		t.Fatalf("tip was added at %d, want between %d and %d", added, before, after)
+	}
+	if view := ViewAt(added, added+2*timeout.Milliseconds(), timeout); view != 2 {
+		t.Errorf("view two timeouts after the tip was added is %d, want 2", view)
+	}
+
+	// A tip that this node did not add is counted from the first time it is seen if its timestamp is ahead of the clock
+	n.node.tipHash = nil
+	if added := n.node.tipAddedAt(n.tip(), after); added != after {
+		t.Errorf("loaded tip from the future was added at %d, want %d", added, after)
+	}
+}
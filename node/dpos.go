@@ -1,10 +1,16 @@
 package node
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"math"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/Animesh-03/scms/core"
 	"github.com/Animesh-03/scms/logger"
@@ -12,18 +18,90 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// Length of the time slots in which the verifiers take turns to propose blocks
+const DefaultSlotDuration = 10 * time.Second
+
+// Slots in which no block was added and the proposers which missed their turn
+type ConsensusMetrics struct {
+	SkippedSlots uint            `json:"skippedslots"`
+	ViewChanges  uint            `json:"viewchanges"`
+	MissedTurns  map[string]uint `json:"missedturns"`
+
+	mu sync.Mutex
+}
+
+// Count a slot in which no block was added
+func (m *ConsensusMetrics) SkipSlot() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.SkippedSlots++
+}
+
+// Count a view change caused by the proposer that missed its turn
+func (m *ConsensusMetrics) ChangeView(proposer string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ViewChanges++
+	m.MissedTurns[proposer]++
+}
+
+// Get a copy of the metrics
+func (m *ConsensusMetrics) Snapshot() ConsensusMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	missed := make(map[string]uint)
+	for proposer, count := range m.MissedTurns {
+		missed[proposer] = count
+	}
+	return ConsensusMetrics{
+		SkippedSlots: m.SkippedSlots,
+		ViewChanges:  m.ViewChanges,
+		MissedTurns:  missed,
+	}
+}
+
+// Error returned when this node already approved another block at the height and view of a block
+var ErrConflictingApproval = errors.New("another block was approved at the same height and view")
+
+// Height and view of the blocks approved by a verifier
+type approvalSlot struct {
+	height uint
+	view   uint32
+}
+
 type DposClient struct {
-	Stakes     map[string]uint `json:"stakes"`
-	Votes      map[string]uint `json:"votes"`
-	Verifiers  []string        `json:"verifiers"`
-	BlockVotes map[string]uint `json:"blockvotes"`
+	// Stakes of the nodes broadcast with their registration
+	Stakes map[string]uint `json:"stakes"`
+	// Verifiers of the current epoch
+	Verifiers []string `json:"verifiers"`
+	// Approvals received for the blocks proposed by this node
+	BlockVotes map[string][]core.Approval `json:"blockvotes"`
+	// Blocks proposed by this node that are waiting for approvals
+	ProposedBlocks map[string]*core.Block `json:"-"`
+	Metrics        *ConsensusMetrics      `json:"metrics"`
+
+	// Hash of the block approved by this node at every height and view
+	approved   map[approvalSlot][]byte
+	approvalMu *sync.Mutex
+	proposalMu *sync.Mutex
+	verifierMu *sync.RWMutex
+	stakeMu    *sync.RWMutex
 }
 
 func NewDposClient() DposClient {
 	return DposClient{
-		Stakes:     make(map[string]uint),
-		Votes:      make(map[string]uint),
-		BlockVotes: make(map[string]uint),
+		Stakes:         make(map[string]uint),
+		BlockVotes:     make(map[string][]core.Approval),
+		ProposedBlocks: make(map[string]*core.Block),
+		Metrics:        &ConsensusMetrics{MissedTurns: make(map[string]uint)},
+		approved:       make(map[approvalSlot][]byte),
+		approvalMu:     &sync.Mutex{},
+		proposalMu:     &sync.Mutex{},
+		verifierMu:     &sync.RWMutex{},
+		stakeMu:        &sync.RWMutex{},
 	}
 }
 
@@ -31,23 +109,273 @@ type RegistrationData struct {
 	PeerId    string          `json:"peerId"`
 	Amount    uint            `json:"amount"`
 	PublicKey ecdsa.PublicKey `json:"publickey"`
+	// Role of the node in the product lifecycle
+	Role string `json:"role"`
+}
+
+// Serialize the client while holding its locks so that it is not changed by the other goroutines
+func (d *DposClient) MarshalJSON() ([]byte, error) {
+	d.proposalMu.Lock()
+	blockVotes := make(map[string][]core.Approval, len(d.BlockVotes))
+	for hash, approvals := range d.BlockVotes {
+		blockVotes[hash] = append([]core.Approval{}, approvals...)
+	}
+	d.proposalMu.Unlock()
+
+	d.verifierMu.RLock()
+	verifiers := append([]string{}, d.Verifiers...)
+	d.verifierMu.RUnlock()
+
+	metrics := d.Metrics.Snapshot()
+
+	return json.Marshal(map[string]interface{}{
+		"stakes":     d.RegisteredStakes(),
+		"verifiers":  verifiers,
+		"blockvotes": blockVotes,
+		"metrics":    &metrics,
+	})
 }
 
 // Adds the stake to the respective node
 func (d *DposClient) RegisterStake(stake RegistrationData) {
+	d.stakeMu.Lock()
+	defer d.stakeMu.Unlock()
+
 	d.Stakes[stake.PeerId] = stake.Amount
 }
 
-func (d *DposClient) ComputeVerfiers(n int) {
-	verifiers := make([]string, 0, len(d.Votes))
-	for k := range d.Votes {
-		verifiers = append(verifiers, k)
+// Get the registered stake of the node
+func (d *DposClient) RegisteredStake(id string) uint {
+	d.stakeMu.RLock()
+	defer d.stakeMu.RUnlock()
+
+	return d.Stakes[id]
+}
+
+// Get a copy of the registered stakes of all the nodes
+func (d *DposClient) RegisteredStakes() map[string]uint {
+	d.stakeMu.RLock()
+	defer d.stakeMu.RUnlock()
+
+	stakes := make(map[string]uint, len(d.Stakes))
+	for id, amount := range d.Stakes {
+		stakes[id] = amount
 	}
-	sort.SliceStable(verifiers, func(i, j int) bool {
-		return d.Votes[verifiers[i]] > d.Votes[verifiers[j]]
-	})
+	return stakes
+}
+
+// Replace the verifiers of the current epoch, returns true if they changed
+func (d *DposClient) SetVerifiers(verifiers []string) bool {
+	d.verifierMu.Lock()
+	defer d.verifierMu.Unlock()
+
+	if equalStrings(d.Verifiers, verifiers) {
+		return false
+	}
+
+	d.Verifiers = verifiers
+	return true
+}
+
+// Get the verifiers of the current epoch
+func (d *DposClient) GetVerifiers() []string {
+	d.verifierMu.RLock()
+	defer d.verifierMu.RUnlock()
+
+	return append([]string{}, d.Verifiers...)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Keep a block proposed by this node until it is approved by the verifiers
+func (d *DposClient) Propose(block *core.Block) {
+	d.proposalMu.Lock()
+	defer d.proposalMu.Unlock()
+
+	d.ProposedBlocks[hex.EncodeToString(block.Hash)] = block
+}
+
+// Record that this node approves the block unless it approved another block at the same height and view.
+// A verifier that approved two blocks at the same height and view could help both of them reach a quorum.
+// The approvals far below the height are dropped since blocks that deep can no longer be added to the chain.
+func (d *DposClient) RecordApproval(block *core.Block) error {
+	d.approvalMu.Lock()
+	defer d.approvalMu.Unlock()
+
+	slot := approvalSlot{height: block.Height, view: block.View}
+	if hash, ok := d.approved[slot]; ok && !bytes.Equal(hash, block.Hash) {
+		return ErrConflictingApproval
+	}
+	d.approved[slot] = block.Hash
+
+	for s := range d.approved {
+		if s.height+MaxReorgDepth < block.Height {
+			delete(d.approved, s)
+		}
+	}
+	return nil
+}
+
+// Add the approval of a verifier to the block proposed by this node.
+// Only the first approval of every verifier is counted. Once the approvals reach
+// the threshold of the quorum the block is returned with its quorum certificate.
+func (d *DposClient) AddApproval(approval core.Approval, quorum *core.Quorum) (*core.Block, bool) {
+	d.proposalMu.Lock()
+	defer d.proposalMu.Unlock()
+
+	hash := hex.EncodeToString(approval.BlockHash)
+	block, ok := d.ProposedBlocks[hash]
+	if !ok {
+		return nil, false
+	}
+
+	approvers := make(map[string]bool)
+	for _, a := range d.BlockVotes[hash] {
+		approvers[a.Verifier] = true
+	}
+	if approvers[approval.Verifier] {
+		return nil, false
+	}
+
+	d.BlockVotes[hash] = append(d.BlockVotes[hash], approval)
+	approvers[approval.Verifier] = true
+
+	if !quorum.Reached(approvers) {
+		return nil, false
+	}
+
+	block.Certificate = core.NewQuorumCertificate(block.Hash, d.BlockVotes[hash])
+	delete(d.ProposedBlocks, hash)
+	delete(d.BlockVotes, hash)
+
+	return block, true
+}
+
+// Check if the node is part of the elected verifiers
+func (d *DposClient) IsVerifier(id string) bool {
+	for _, v := range d.GetVerifiers() {
+		if v == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the verifier scheduled to propose the block of the given version at the given height and view.
+// The verifiers take turns with RuleProposerTurns and every view change passes the turn to the next verifier
+// with RuleViewChanges, the blocks of earlier versions are proposed by the top verifier.
+func (d *DposClient) ProposerFor(version uint32, height uint, view uint32) string {
+	return proposerFor(d.GetVerifiers(), version, height, view)
+}
+
+func proposerFor(verifiers []string, version uint32, height uint, view uint32) string {
+	if len(verifiers) == 0 {
+		return ""
+	}
+	if !core.HasRule(version, core.RuleProposerTurns) {
+		return verifiers[0]
+	}
+	if !core.HasRule(version, core.RuleViewChanges) {
+		view = 0
+	}
+
+	return verifiers[(height+uint(view))%uint(len(verifiers))]
+}
+
+// Get the view of the block above a tip added at the given time, at the given time in milliseconds.
+// The view increases every timeout after the tip was added so that the verifiers agree on it without
+// exchanging messages, up to the delay with which the tip reached them.
+func ViewAt(added int64, now int64, timeout time.Duration) uint32 {
+	if now <= added {
+		return 0
+	}
+
+	view := (now - added) / timeout.Milliseconds()
+	if view > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(view)
+}
 
-	d.Verifiers = verifiers[:n]
+// Wait for the start of the next slot and get its number.
+// Slots start at multiples of the slot duration so that every node uses the same slots.
+func WaitForSlot(duration time.Duration) int64 {
+	length := duration.Milliseconds()
+	now := time.Now().UnixMilli()
+	next := (now/length + 1) * length
+	time.Sleep(time.Duration(next-now) * time.Millisecond)
+
+	return next / length
+}
+
+// Store the public key, role and stake of a registered node and the peer it was received from
+func (node *Node) addRegistration(registration RegistrationData, from peer.ID) {
+	node.registryMu.Lock()
+	defer node.registryMu.Unlock()
+
+	node.PubKeyMap[registration.PeerId] = registration.PublicKey
+	node.RoleMap[registration.PeerId] = registration.Role
+	node.PeerMap[registration.PeerId] = from
+	node.IDMap[from] = registration.PeerId
+	node.Dpos.RegisterStake(registration)
+}
+
+// Get the public key of the registered node
+func (node *Node) PublicKey(id string) (ecdsa.PublicKey, bool) {
+	node.registryMu.RLock()
+	defer node.registryMu.RUnlock()
+
+	pubKey, ok := node.PubKeyMap[id]
+	return pubKey, ok
+}
+
+// Get a copy of the public keys of the registered nodes
+func (node *Node) PublicKeys() map[string]ecdsa.PublicKey {
+	node.registryMu.RLock()
+	defer node.registryMu.RUnlock()
+
+	pubKeys := make(map[string]ecdsa.PublicKey, len(node.PubKeyMap))
+	for id, pubKey := range node.PubKeyMap {
+		pubKeys[id] = pubKey
+	}
+	return pubKeys
+}
+
+// Get a copy of the roles of the registered nodes
+func (node *Node) Roles() map[string]string {
+	node.registryMu.RLock()
+	defer node.registryMu.RUnlock()
+
+	roles := make(map[string]string, len(node.RoleMap))
+	for id, role := range node.RoleMap {
+		roles[id] = role
+	}
+	return roles
+}
+
+// Get the sorted IDs of the registered nodes
+func (node *Node) RegisteredNodes() []string {
+	node.registryMu.RLock()
+	defer node.registryMu.RUnlock()
+
+	ids := make([]string, 0, len(node.PubKeyMap))
+	for id := range node.PubKeyMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 func RegistrationHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
@@ -61,29 +389,107 @@ func RegistrationHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
 		var stake RegistrationData
 		json.Unmarshal(msg.Data, &stake)
 
-		node.PubKeyMap[stake.PeerId] = stake.PublicKey
-		node.PeerMap[stake.PeerId] = msg.ReceivedFrom
-		node.IDMap[msg.ReceivedFrom] = stake.PeerId
-		node.Dpos.RegisterStake(stake)
+		node.addRegistration(stake, msg.ReceivedFrom)
 
-		logger.LogInfo("Registered node %s with stake amount: %d\n", stake.PeerId, stake.Amount)
+		logger.LogInfo("Registered %s node %s with stake amount: %d\n", stake.Role, stake.PeerId, stake.Amount)
 	}
 }
 
-func VotingHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
-	for {
-		msg, err := sub.Next(context.Background())
-		if err != nil {
-			logger.LogError("Error reading from %s\n", sub.Topic())
-			return
+// Broadcast a transaction which stakes the amount for this node in the election of the verifiers
+func (node *Node) SubmitStake(amount uint64) (*core.Transaction, error) {
+	transaction := core.NewStakeTransaction(node.ID, amount, node.NextNonce(), node.ChainID)
+	if err := node.State().CheckTransitions(core.CurrentBlockVersion, node.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, node.Roles()); err != nil {
+		return nil, err
+	}
+	node.SignTransaction(transaction)
+
+	node.Network.Broadcast("transaction", transaction.Encode())
+
+	return transaction, nil
+}
+
+// Broadcast a transaction which votes for the candidates in the election of the verifiers.
+// The vote replaces the earlier vote of this node, which is withdrawn if there are no candidates.
+func (node *Node) SubmitVote(candidates []string) (*core.Transaction, error) {
+	transaction := core.NewVoteTransaction(node.ID, candidates, node.NextNonce(), node.ChainID)
+	if err := node.State().CheckTransitions(core.CurrentBlockVersion, node.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, node.Roles()); err != nil {
+		return nil, err
+	}
+	node.SignTransaction(transaction)
+
+	node.Network.Broadcast("transaction", transaction.Encode())
+
+	return transaction, nil
+}
+
+// Get the verifiers of the current epoch and the weights of their approvals
+func (node *Node) Quorum() *core.Quorum {
+	return node.quorumFor(node.State())
+}
+
+// Get the verifiers elected in the state and the weights of their approvals.
+// Approvals are counted once if they are not weighed by stake or the verifiers have no stake.
+func (node *Node) quorumFor(state *core.State) *core.Quorum {
+	quorum := &core.Quorum{
+		Verifiers: state.ElectedVerifiers(),
+		Threshold: node.Election.Threshold,
+	}
+	if !node.Election.WeighByStake {
+		return quorum
+	}
+
+	// Every approval counts once if none of the verifiers has a stake
+	weights := make(map[string]uint64)
+	staked := false
+	for _, v := range quorum.Verifiers {
+		weights[v] = state.Stake(v)
+		staked = staked || weights[v] > 0
+	}
+	if staked {
+		quorum.Weights = weights
+	}
+
+	return quorum
+}
+
+// Get the view of the next block at the current time
+func (node *Node) CurrentView() uint32 {
+	now := time.Now().UnixMilli()
+	return ViewAt(node.tipAddedAt(node.Blockchain.Tip(), now), now, node.ViewTimeout)
+}
+
+// Get the time at which this node added the tip to its chain.
+// The views are counted from this time and not from the timestamp chosen by the proposer, so a proposer can not
+// delay the view change with a timestamp ahead of the clock. A tip which was loaded from the block store is counted
+// from its timestamp, or from the first time it is seen if the timestamp is still in the future. The genesis block
+// has the timestamp 0 on every node, so above it the view follows the clock.
+func (node *Node) tipAddedAt(tip *core.Block, now int64) int64 {
+	node.tipMu.Lock()
+	defer node.tipMu.Unlock()
+
+	if !bytes.Equal(node.tipHash, tip.Hash) {
+		node.tipHash = tip.Hash
+		node.tipAdded = tip.Timestamp
+		if now < tip.Timestamp {
+			node.tipAdded = now
 		}
+	}
+	return node.tipAdded
+}
 
-		var voteNode string
-		json.Unmarshal(msg.Data, &voteNode)
+// Record the time at which this node added the block as the tip of its chain
+func (node *Node) setTipAdded(tip *core.Block, added int64) {
+	node.tipMu.Lock()
+	defer node.tipMu.Unlock()
 
-		logger.LogInfo("Received vote from %s to %s\n", node.IDMap[msg.ReceivedFrom], voteNode)
+	node.tipHash = tip.Hash
+	node.tipAdded = added
+}
 
-		node.Dpos.Votes[node.IDMap[msg.ReceivedFrom]] += node.Dpos.Stakes[node.IDMap[msg.ReceivedFrom]]
+// Use the verifiers elected on the chain for the current epoch, or the bootstrap verifiers until the first epoch ends
+func (node *Node) UpdateVerifiers() {
+	if node.Dpos.SetVerifiers(node.State().ElectedVerifiers()) {
+		logger.LogInfo("Verifiers of epoch %d are: %+v\n", node.State().CurrentEpoch(), node.Dpos.GetVerifiers())
 	}
 }
 
@@ -95,20 +501,52 @@ func BlockVerificationHandler(sub *pubsub.Subscription, self peer.ID, node *Node
 			return
 		}
 
-		var block core.Block
-		json.Unmarshal(msg.Data, &block)
+		block, err := core.DecodeBlock(msg.Data)
+		if err != nil {
+			logger.LogWarn("Error decoding block to verify: %s\n", err.Error())
+			continue
+		}
+
+		// Only the verifiers of the current epoch approve blocks
+		if !node.Dpos.IsVerifier(node.ID) {
+			continue
+		}
+
+		// New blocks must follow the rules of the current version, older versions are only valid for blocks already on the chain
+		if block.Version != core.CurrentBlockVersion {
+			logger.LogWarn("Received block %d of version %d to verify\n", block.Height, block.Version)
+			continue
+		}
+
+		// A verifier may only take over the turn of the scheduled proposer after the view timed out
+		if view := node.CurrentView(); block.View > view {
+			logger.LogWarn("Received block %d for view %d in view %d\n", block.Height, block.View, view)
+			continue
+		}
 
 		logger.LogInfo("Received block to verify: %+v\n", block.Stringify())
 
-		if node.VerifyBlock(&block) {
-			node.Network.Broadcast("block.verified", []byte(block.Stringify()))
-		} else {
+		if !node.VerifyBlock(block) {
 			logger.LogWarn("Received Invalid block to verify: %+v\n", block)
+			continue
 		}
 
+		approval, err := node.ApproveBlock(block)
+		if errors.Is(err, ErrConflictingApproval) {
+			logger.LogWarn("Refusing to approve block %x of %s: %s\n", block.Hash, block.Proposer, err)
+			continue
+		}
+		if err != nil {
+			logger.LogError("Error approving block: %s\n", err.Error())
+			continue
+		}
+
+		node.Network.Broadcast("block.verified", approval.Encode())
 	}
 }
 
+// Aggregate the approvals of the verifiers for the blocks proposed by this node
+// and broadcast a block with its quorum certificate once the approvals reach the threshold of the quorum
 func BlockVerifiedHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
 	for {
 		msg, err := sub.Next(context.Background())
@@ -117,20 +555,25 @@ func BlockVerifiedHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
 			return
 		}
 
-		var block core.Block
-		json.Unmarshal(msg.Data, &block)
+		approval, err := core.DecodeApproval(msg.Data)
+		if err != nil {
+			logger.LogWarn("Error decoding approval: %s\n", err.Error())
+			continue
+		}
 
-		logger.LogInfo("Block Verified with hash: %+v\n", block.Stringify())
+		pubKey, ok := node.PublicKey(approval.Verifier)
+		if !node.Dpos.IsVerifier(approval.Verifier) || !ok || !approval.Verify(pubKey) {
+			logger.LogWarn("Received invalid approval from %s for block %x\n", approval.Verifier, approval.BlockHash)
+			continue
+		}
 
-		node.Dpos.BlockVotes[string(block.Hash)]++
+		logger.LogInfo("Block %x approved by %s\n", approval.BlockHash, approval.Verifier)
 
-		blockBytes, err := json.Marshal(block)
-		if err != nil {
-			logger.LogError("Error Marhsalling block: %+v\n", block.Stringify())
+		block, ok := node.Dpos.AddApproval(*approval, node.Quorum())
+		if !ok {
+			continue
 		}
 
-		if node.Dpos.BlockVotes[string(block.Hash)] == uint(len(node.Dpos.Verifiers)) {
-			node.Network.Broadcast("block.add", blockBytes)
-		}
+		node.Network.Broadcast("block.add", block.Encode())
 	}
 }
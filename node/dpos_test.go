@@ -0,0 +1,41 @@
+package node
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifierApprovesOneBlockPerHeightAndView(t *testing.T) {
+	n := newTestNode(t)
+	n.node.ID = "a"
+	n.node.PrivKey = n.keys["a"]
+	chain := n.extend(1)
+
+	block := n.block(chain[1], 0)
+	if _, err := n.node.ApproveBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.node.ApproveBlock(block); err != nil {
+		t.Errorf("approving the same block again returned %v", err)
+	}
+
+	// Another block at the same height and view is refused
+	if _, err := n.node.ApproveBlock(n.block(chain[1], 1)); !errors.Is(err, ErrConflictingApproval) {
+		t.Errorf("approving a second block at the same height and view returned %v", err)
+	}
+
+	// A block proposed after a view change can be approved
+	next := n.block(chain[1], 2)
+	next.View = 1
+	next.Proposer = proposerFor(n.node.Election.Bootstrap, next.Version, next.Height, next.View)
+	n.sign(next)
+	approval, err := n.node.ApproveBlock(next)
+	if err != nil {
+		t.Fatalf("approving a block of the next view returned %v", err)
+	}
+
+	pubKey, _ := n.node.PublicKey("a")
+	if !approval.Verify(pubKey) {
+		t.Error("approval is not signed by the verifier")
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	crand "crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,6 +22,7 @@ import (
 	"github.com/Animesh-03/scms/logger"
 	"github.com/Animesh-03/scms/p2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/gin-gonic/gin"
@@ -30,28 +36,157 @@ const (
 	Consumer     NodeType = 3
 )
 
+// Get the name of the lifecycle role of the node type
+func (t NodeType) Role() string {
+	switch t {
+	case Manufacturer:
+		return "manufacturer"
+	case Distribtor:
+		return "distributor"
+	case Consumer:
+		return "consumer"
+	}
+
+	return ""
+}
+
 type Node struct {
 	ID      string
 	Type    NodeType
-	Network *p2p.MDNSNetwork
-
-	Blockchain     []core.Block
-	MemPool        *core.MemPool
-	CurrentProduct string
-	PubKeyMap      map[string]ecdsa.PublicKey
-	PeerMap        map[string]peer.ID
-	IDMap          map[peer.ID]string
+	DataDir string
+	ChainID string
+	// Role of the node in the lifecycle of the products, defaults to the role of its type
+	Role      string
+	Lifecycle *core.Lifecycle
+	// Rules of the election of the verifiers, shared by every node of the chain
+	Election core.Election
+	// Length of the time slots in which the verifiers take turns to propose blocks
+	SlotDuration time.Duration
+	// Time without a new block after which the next verifier proposes the block
+	ViewTimeout time.Duration
+	// Maximum number of open shipments of the node, 0 for no limit
+	MaxShipments uint
+	Network      *p2p.MDNSNetwork
+	// Called when a block completes the return of a product so that the consumer can be refunded
+	OnRefund func(product *core.ProductState)
+	// Called when a dispute on a product is decided against a node
+	OnDispute func(productId string, nodeID string)
+
+	Blockchain core.BlockStore
+	SideChain  *core.BlockPool
+	MemPool    *core.MemPool
+	PubKeyMap  map[string]ecdsa.PublicKey
+	RoleMap    map[string]string
+	PeerMap    map[string]peer.ID
+	IDMap      map[peer.ID]string
 
 	PrivKey *ecdsa.PrivateKey
 	PubKey  *ecdsa.PublicKey
 
 	Dpos DposClient
+
+	chainMu sync.Mutex
+	syncMu  sync.Mutex
+	nonceMu sync.Mutex
+	// Guards the public keys, roles and peers of the registered nodes
+	registryMu sync.RWMutex
+	// State of the chain up to the tip, which is replaced when the chain is rebuilt or reorganized
+	state   *core.State
+	stateMu sync.RWMutex
+	// Hash of the tip and the time in milliseconds at which this node added it
+	tipHash  []byte
+	tipAdded int64
+	tipMu    sync.Mutex
+	// Last nonce used by this node
+	nonce    uint64
+	refundMu sync.Mutex
+	// Returns whose refund was notified, by the ID of the transaction that started the return
+	refunded map[string]bool
+}
+
+// Snapshot of the node returned by the info RPC. The maps of the node are copied
+// or serialized under their locks so that blocks can be applied while it is sent.
+type NodeInfo struct {
+	ID         string
+	Type       NodeType
+	ChainID    string
+	Role       string
+	Election   core.Election
+	Blockchain core.BlockStore
+	SideChain  *core.BlockPool
+	State      *core.State
+	MemPool    *core.MemPool
+	PubKeyMap  map[string]ecdsa.PublicKey
+	RoleMap    map[string]string
+	PeerMap    map[string]peer.ID
+	PubKey     *ecdsa.PublicKey
+	Dpos       *DposClient
+}
+
+func (node *Node) Info() NodeInfo {
+	node.registryMu.RLock()
+	peers := make(map[string]peer.ID, len(node.PeerMap))
+	for id, p := range node.PeerMap {
+		peers[id] = p
+	}
+	node.registryMu.RUnlock()
+
+	return NodeInfo{
+		ID:         node.ID,
+		Type:       node.Type,
+		ChainID:    node.ChainID,
+		Role:       node.Role,
+		Election:   node.Election,
+		Blockchain: node.Blockchain,
+		SideChain:  node.SideChain,
+		State:      node.State(),
+		MemPool:    node.MemPool,
+		PubKeyMap:  node.PublicKeys(),
+		RoleMap:    node.Roles(),
+		PeerMap:    peers,
+		PubKey:     node.PubKey,
+		Dpos:       &node.Dpos,
+	}
 }
 
 // Initialize the node by joining the network
 func (node *Node) Start(config *p2p.NetworkConfig) {
 	// Initialize Node
-	node.CurrentProduct = ""
+	if node.Lifecycle == nil {
+		node.Lifecycle = core.DefaultLifecycle()
+	}
+	if node.Role == "" {
+		node.Role = node.Type.Role()
+	}
+	if !node.Lifecycle.HasRole(node.Role) {
+		logger.LogError("Role %s is not defined by the lifecycle\n", node.Role)
+		return
+	}
+	if node.Election.EpochLength == 0 {
+		node.Election.EpochLength = core.DefaultEpochLength
+	}
+	if node.Election.Verifiers == 0 {
+		node.Election.Verifiers = core.DefaultVerifierCount
+	}
+	if len(node.Election.Bootstrap) == 0 {
+		logger.LogError("No bootstrap verifiers are set for the first epoch\n")
+		return
+	}
+	if node.Election.Threshold.Denominator == 0 {
+		node.Election.Threshold = core.DefaultThreshold()
+	}
+	if node.SlotDuration == 0 {
+		node.SlotDuration = DefaultSlotDuration
+	}
+	if node.ViewTimeout == 0 {
+		node.ViewTimeout = 2 * node.SlotDuration
+	}
+	if node.OnRefund == nil {
+		node.OnRefund = node.LogRefund
+	}
+	if node.OnDispute == nil {
+		node.OnDispute = node.LogDispute
+	}
 
 	// Initialize the network
 	net := p2p.MDNSNetwork{}
@@ -61,79 +196,98 @@ func (node *Node) Start(config *p2p.NetworkConfig) {
 	node.ID = fmt.Sprintf("%d", config.ListenPort)
 	node.Network = &net
 	node.MemPool = core.NewMemPool()
-	node.Blockchain = make([]core.Block, 0)
-	node.Blockchain = append(node.Blockchain, *core.CreateGenesisBlock())
+	node.SideChain = core.NewBlockPool()
 	node.Dpos = NewDposClient()
 
+	if err := node.OpenBlockchain(); err != nil {
+		logger.LogError("Error opening blockchain: %s\n", err.Error())
+		return
+	}
+	defer node.Blockchain.Close()
+
+	// The role registered on the chain can not be changed
+	if role := node.State().Role(node.ID); role != "" && role != node.Role {
+		logger.LogWarn("Role %s is registered on the chain instead of %s\n", role, node.Role)
+		node.Role = role
+	}
+
 	node.PubKeyMap = make(map[string]ecdsa.PublicKey)
+	node.RoleMap = make(map[string]string)
 	node.PeerMap = make(map[string]peer.ID)
 	node.IDMap = make(map[peer.ID]string)
 
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
-	if err != nil {
+	if err := node.LoadKey(); err != nil {
 		logger.LogError("Error initializing node: %s\n", err.Error())
 		return
 	}
-	node.PrivKey = privKey
-	node.PubKey = &privKey.PublicKey
 
 	node.SetupListeners()
 	go node.SetupRPCs(uint(config.ListenPort + 1000))
 
 	// Register the node after a delay (to wait for all the other nodes to initialize)
 	// Stake a random amount of tokens < 30
+	stakeAmount := uint(rand.Int()) % 30
 	go func() {
 		time.Sleep(10 * time.Second)
-		node.Register(uint(rand.Int()) % 30)
+		node.Register(stakeAmount)
+	}()
+
+	// Catch up with the blocks produced before this node joined
+	// after the registrations of the other nodes are received
+	go func() {
+		time.Sleep(12 * time.Second)
+		node.SyncChain()
 	}()
 
-	// Vote for a random node after a delay (to wait for all the other nodes to initialize)
+	// Record the role and the stake on the chain and vote for a random node after a delay (to wait for all the other nodes to initialize)
 	go func() {
 		time.Sleep(15 * time.Second)
+		if node.State().Role(node.ID) == "" {
+			if _, err := node.RegisterRole(); err != nil {
+				logger.LogWarn("Error registering role: %s\n", err.Error())
+			}
+		}
+		if _, err := node.SubmitStake(uint64(stakeAmount)); err != nil {
+			logger.LogWarn("Error staking: %s\n", err.Error())
+		}
 		node.VoteRandomNode()
 	}()
 
-	// Compute the final votes
-	// If this node is part of the verifers then register a listener for block verification
+	// Propose a block in every slot in which this node is scheduled to propose the next block.
+	// If the scheduled proposer is silent until the view times out then the next verifier proposes it.
 	go func() {
-		time.Sleep(20 * time.Second)
-		node.Dpos.ComputeVerfiers(2)
-		logger.LogInfo("Final Votes are: %+v\n", node.Dpos.Votes)
-		logger.LogInfo("Verifiers are: %+v\n", node.Dpos.Verifiers)
-
-		for _, v := range node.Dpos.Verifiers {
-			if v == node.ID {
-				// Add verifier listener
-				node.Network.ListenBroadcast("block.verify", func(sub *pubsub.Subscription, self peer.ID) { BlockVerificationHandler(sub, self, node) })
-				break
+		var lastHeight uint
+		var lastView uint32
+		for {
+			slot := WaitForSlot(node.SlotDuration)
+
+			height := node.Blockchain.Tip().Height + 1
+			view := node.CurrentView()
+			if len(node.Dpos.GetVerifiers()) == 0 {
+				continue
 			}
-		}
 
-		// If the node is the top elected node
-		if node.Dpos.Verifiers[0] == node.ID {
-			// Add blocks
-			logger.LogInfo("This node is selected to create blocks\n")
-
-			go func() {
-				// Create a block every 10 seconds
-				for {
-					time.Sleep(10 * time.Second)
-
-					// Create a block and broadcast it to the verifiers to be verified
-					block := node.CreateBlock()
-					blockBytes, err := json.Marshal(block)
-					if err != nil {
-						logger.LogError("Error marshalling block for broadcast: %+v\n", block.Stringify())
-						continue
-					}
-					node.Network.Broadcast("block.verify", blockBytes)
+			if height == lastHeight {
+				node.Dpos.Metrics.SkipSlot()
+				logger.LogWarn("Slot %d passed without block %d\n", slot-1, height)
+
+				for v := lastView; v < view; v++ {
+					missed := node.Dpos.ProposerFor(core.CurrentBlockVersion, height, v)
+					node.Dpos.Metrics.ChangeView(missed)
+					logger.LogWarn("Proposer %s missed block %d, changing to view %d\n", missed, height, v+1)
 				}
-			}()
+			}
+			lastHeight, lastView = height, view
 
-			// Handle the consensus of the block that is generated above
-			// 1. Add the verification of the block
-			// 2. If all the verifiers approve the block then broadcast the block to all other nodes
-			node.Network.ListenBroadcast("block.verified", func(sub *pubsub.Subscription, self peer.ID) { BlockVerifiedHandler(sub, self, node) })
+			if node.Dpos.ProposerFor(core.CurrentBlockVersion, height, view) != node.ID {
+				continue
+			}
+			logger.LogInfo("Proposing block %d in slot %d and view %d\n", height, slot, view)
+
+			// Create a block and broadcast it to the verifiers to be verified
+			block := node.CreateBlock(view)
+			node.Dpos.Propose(block)
+			node.Network.Broadcast("block.verify", block.Encode())
 		}
 	}()
 
@@ -158,31 +312,19 @@ func (node *Node) SetupListeners() {
 	// 2. Store the public key of the node
 	node.Network.ListenBroadcast("register", func(sub *pubsub.Subscription, self peer.ID) { RegistrationHandler(sub, self, node) })
 
-	// Handle the vote of a node for DPOS
-	// 1. Add the vote to the node
-	node.Network.ListenBroadcast("vote", func(sub *pubsub.Subscription, self peer.ID) { VotingHandler(sub, self, node) })
-
-	// Handle the addition of a block after it is verified by all the verifiers
+	// Handle the addition of a block after its approvals reached the threshold of the quorum
 	node.Network.ListenBroadcast("block.add", func(sub *pubsub.Subscription, self peer.ID) { BlockAddHandler(sub, self, node) })
 
-	node.Network.ListenBroadcast("dispute", func(sub *pubsub.Subscription, self peer.ID) {
-		for {
-			msg, err := sub.Next(context.Background())
-			if err != nil {
-				logger.LogError("Error reading from %s\n", sub.Topic())
-				return
-			}
-
-			var nodeID string
-			json.Unmarshal(msg.Data, &nodeID)
+	// Verify the blocks proposed by the other verifiers, only the verifiers of the current epoch approve them
+	node.Network.ListenBroadcast("block.verify", func(sub *pubsub.Subscription, self peer.ID) { BlockVerificationHandler(sub, self, node) })
 
-			logger.LogWarn("Node Deduct ID: a%sa %s", nodeID, msg.Data)
+	// Handle the consensus of the blocks proposed by this node
+	// 1. Add the verification of the block
+	// 2. If the approvals reach the threshold of the quorum then broadcast the block with the certificate to all other nodes
+	node.Network.ListenBroadcast("block.verified", func(sub *pubsub.Subscription, self peer.ID) { BlockVerifiedHandler(sub, self, node) })
 
-			node.Dpos.Stakes[string(msg.Data)] -= 10
-
-			logger.LogInfo("Stake deducted from node: %s\n", string(msg.Data))
-		}
-	})
+	// Serve the blocks of the chain to the nodes that are catching up
+	node.Network.AddStream(SyncProtocol, func(stream network.Stream) { SyncStreamHandler(stream, node) })
 
 	logger.LogInfo("Listeners Setup Successfully\n")
 }
@@ -193,15 +335,30 @@ func (node *Node) SetupRPCs(port uint) {
 
 	router.POST("/transaction", func(ctx *gin.Context) { SendTransaction(ctx, node) })
 	router.GET("/info", func(ctx *gin.Context) { GetNodeInfo(ctx, node) })
+	router.POST("/accept", func(ctx *gin.Context) { AcceptOffer(ctx, node) })
+	router.POST("/reject", func(ctx *gin.Context) { RejectOffer(ctx, node) })
+	router.POST("/pack", func(ctx *gin.Context) { PackProducts(ctx, node) })
+	router.POST("/unpack", func(ctx *gin.Context) { UnpackProducts(ctx, node) })
+	router.POST("/recall", func(ctx *gin.Context) { RecallProduct(ctx, node) })
 	router.POST("/product_status", func(ctx *gin.Context) { GetProductStatus(ctx, node) })
 	router.POST("/dispute", func(ctx *gin.Context) { Dispute(ctx, node) })
+	router.POST("/product_history", func(ctx *gin.Context) { GetProductHistory(ctx, node) })
+	router.POST("/product_custody", func(ctx *gin.Context) { GetProductCustody(ctx, node) })
+	router.POST("/recall_status", func(ctx *gin.Context) { GetProductRecall(ctx, node) })
+	router.POST("/stake", func(ctx *gin.Context) { SubmitStake(ctx, node) })
+	router.POST("/vote", func(ctx *gin.Context) { SubmitVote(ctx, node) })
+	router.GET("/election", func(ctx *gin.Context) { GetElection(ctx, node) })
+	router.GET("/schedule", func(ctx *gin.Context) { GetSchedule(ctx, node) })
+	router.GET("/metrics", func(ctx *gin.Context) { GetConsensusMetrics(ctx, node) })
+	router.POST("/shipments", func(ctx *gin.Context) { GetOpenShipments(ctx, node) })
+	router.POST("/transaction_proof", func(ctx *gin.Context) { GetTransactionProof(ctx, node) })
 
 	router.Run(fmt.Sprintf("0.0.0.0:%d", port))
 }
 
 // Sign A Transaction
 func (node *Node) SignTransaction(tx *core.Transaction) {
-	signature, err := ecdsa.SignASN1(crand.Reader, node.PrivKey, tx.Bytes())
+	signature, err := ecdsa.SignASN1(crand.Reader, node.PrivKey, tx.SigningDigest())
 	logger.LogInfo("Tx PubKey: %+v\n", node.PubKey)
 	if err != nil {
 		logger.LogError("Error signing tx: %s\n", err.Error())
@@ -211,18 +368,171 @@ func (node *Node) SignTransaction(tx *core.Transaction) {
 	tx.Signature = signature
 }
 
-func (node *Node) CreateBlock() *core.Block {
-	block := core.NewBlock(node.MemPool.GetTransactions(5), node.Blockchain[len(node.Blockchain)-1].Hash, node.Blockchain[len(node.Blockchain)-1].Height+1)
+// Open the block store in the data directory of the node
+// and initialize it with the genesis block if it is empty
+func (node *Node) OpenBlockchain() error {
+	dir := filepath.Join(node.DataDir, node.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	store, err := core.OpenFileBlockStore(filepath.Join(dir, "blocks.dat"))
+	if err != nil {
+		return err
+	}
+
+	if store.Tip() == nil {
+		if err := store.Append(core.CreateGenesisBlock()); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	node.Blockchain = store
+	logger.LogInfo("Loaded blockchain with height %d\n", store.Tip().Height)
+
+	return node.RebuildState()
+}
+
+// Load the key of the node from the data directory, or generate it on the first start.
+// The key is kept so that the blocks and transactions signed before a restart still verify.
+func (node *Node) LoadKey() error {
+	path := filepath.Join(node.DataDir, node.ID, "key.pem")
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return node.generateKey(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no key found in %s", path)
+	}
+	privKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	node.PrivKey = privKey
+	node.PubKey = &privKey.PublicKey
+	return nil
+}
+
+func (node *Node) generateKey(path string) error {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	node.PrivKey = privKey
+	node.PubKey = &privKey.PublicKey
+	logger.LogInfo("Generated new key at %s\n", path)
+	return nil
+}
+
+func (node *Node) CreateBlock(view uint32) *core.Block {
+	tip := node.Blockchain.Tip()
+	block := core.NewBlock(node.SelectTransactions(5), tip.Hash, tip.Height+1, view, node.ID)
+	node.SignBlock(block)
 	return block
 }
 
+// Select the transactions from the mempool that can be included in the next block
+func (node *Node) SelectTransactions(count int) []*core.Transaction {
+	now := time.Now().UnixMilli()
+	height := node.Blockchain.Tip().Height + 1
+	nonces := make(map[string]uint64)
+	roles := node.Roles()
+
+	txs := make([]*core.Transaction, 0, count)
+	for _, tx := range node.MemPool.GetTransactions(node.MemPool.Size()) {
+		if len(txs) == count {
+			break
+		}
+
+		if err := tx.CheckReplayGuard(node.ChainID, now); err != nil {
+			continue
+		}
+
+		nonce, ok := nonces[tx.Sender]
+		if !ok {
+			nonce = node.State().Nonce(tx.Sender)
+		}
+		if tx.Nonce <= nonce {
+			continue
+		}
+
+		// Skip transactions whose product can not make the transition yet
+		if err := node.State().CheckTransitions(core.CurrentBlockVersion, height, append(txs, tx), roles); err != nil {
+			continue
+		}
+
+		nonces[tx.Sender] = tx.Nonce
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+// Sign the hash of a block proposed by this node
+func (node *Node) SignBlock(block *core.Block) {
+	signature, err := ecdsa.SignASN1(crand.Reader, node.PrivKey, block.Hash)
+	if err != nil {
+		logger.LogError("Error signing block: %s\n", err.Error())
+		return
+	}
+
+	block.Signature = signature
+}
+
+// Verify the block proposed above the tip of the chain
 func (node *Node) VerifyBlock(block *core.Block) bool {
-	return block.Verify(&node.Blockchain[len(node.Blockchain)-1], node.PubKeyMap)
+	return node.verifyBlockAt(block, node.Blockchain.Tip(), node.State())
+}
+
+// Verify the block above the previous block against the state of the chain up to the previous block
+func (node *Node) verifyBlockAt(block *core.Block, prevBlock *core.Block, state *core.State) bool {
+	proposer := proposerFor(state.ElectedVerifiers(), block.Version, block.Height, block.View)
+	return block.Verify(prevBlock, state, node.PublicKeys(), node.Roles(), proposer)
+}
+
+// Sign an approval of a block that was verified by this node, at most one block is approved at every height and view
+func (node *Node) ApproveBlock(block *core.Block) (*core.Approval, error) {
+	if err := node.Dpos.RecordApproval(block); err != nil {
+		return nil, err
+	}
+
+	signature, err := ecdsa.SignASN1(crand.Reader, node.PrivKey, core.ApprovalDigest(block.Hash))
+	if err != nil {
+		return nil, err
+	}
+
+	approval := &core.Approval{
+		Verifier:  node.ID,
+		BlockHash: block.Hash,
+		Signature: signature,
+	}
+	return approval, nil
 }
 
-func (node *Node) AddBlockToBlockChain(block *core.Block) {
-	node.Blockchain = append(node.Blockchain, *block)
-	node.MemPool.RemoveAll(block.Transactions)
+// Verify that the block was approved by the verifiers elected in the state before it is committed
+func (node *Node) VerifyCertificate(block *core.Block, state *core.State) bool {
+	if block.Certificate == nil {
+		return false
+	}
+
+	return block.Certificate.Verify(block.Hash, node.quorumFor(state), node.PublicKeys())
 }
 
 // Broadcast the stake to register
@@ -232,6 +542,7 @@ func (node *Node) Register(stakeAmount uint) {
 		PeerId:    node.ID,
 		Amount:    stakeAmount,
 		PublicKey: *node.PubKey,
+		Role:      node.Role,
 	}
 	stakeBytes, err := json.Marshal(stake)
 	if err != nil {
@@ -250,21 +561,40 @@ func BlockAddHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
 			return
 		}
 
-		var block core.Block
-		json.Unmarshal(msg.Data, &block)
+		block, err := core.DecodeBlock(msg.Data)
+		if err != nil {
+			logger.LogWarn("Error decoding block: %s\n", err.Error())
+			continue
+		}
+
+		err = node.AddBlockToBlockChain(block)
+		if err == ErrDuplicateBlock {
+			continue
+		}
+		if err == ErrOrphanBlock {
+			// Blocks are missing between the chain and the received block so catch up with the peers
+			logger.LogWarn("Received orphan block %d at tip %d, syncing\n", block.Height, node.Blockchain.Tip().Height)
+			go node.SyncChain()
+			continue
+		}
+		if err != nil {
+			logger.LogWarn("Error adding block %d: %s\n", block.Height, err.Error())
+			continue
+		}
 
 		logger.LogInfo("Added block: %+v\n", block.Stringify())
-
-		node.AddBlockToBlockChain(&block)
 	}
 }
 
+// Vote on the chain for a random registered node
 func (node *Node) VoteRandomNode() {
-	keys := make([]string, 0, len(node.PubKeyMap))
-	for k := range node.PubKeyMap {
-		keys = append(keys, k)
+	keys := node.RegisteredNodes()
+	if len(keys) == 0 {
+		return
 	}
 
-	voteNode := keys[rand.Int()%len(node.PeerMap)]
-	node.Network.Broadcast("vote", []byte(voteNode))
+	voteNode := keys[rand.Int()%len(keys)]
+	if _, err := node.SubmitVote([]string{voteNode}); err != nil {
+		logger.LogWarn("Error voting: %s\n", err.Error())
+	}
 }
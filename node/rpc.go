@@ -2,6 +2,7 @@ package node
 
 import (
 	"encoding/base64"
+	"time"
 
 	"github.com/Animesh-03/scms/core"
 	"github.com/Animesh-03/scms/logger"
@@ -12,12 +13,16 @@ import (
 type SendTransactionData struct {
 	Reciever  string `json:"receiver"`
 	ProductId string `json:"productid"`
+	// Name of the state of the lifecycle the product is moved to
+	Status string `json:"status"`
+	// Products of the lot that is created with the ID of the product
+	Products []string `json:"products"`
 }
 
 func SendTransaction(c *gin.Context, node *Node) {
 	var transactionData SendTransactionData
 	c.BindJSON(&transactionData)
-	transaction, err := node.MakeTransaction(transactionData.Reciever, transactionData.ProductId)
+	transaction, err := node.MakeTransaction(transactionData.Reciever, transactionData.ProductId, transactionData.Status, transactionData.Products)
 	if err != nil {
 		c.IndentedJSON(500, gin.H{
 			"error": err.Error(),
@@ -29,7 +34,7 @@ func SendTransaction(c *gin.Context, node *Node) {
 }
 
 func GetNodeInfo(c *gin.Context, node *Node) {
-	c.IndentedJSON(200, node)
+	c.IndentedJSON(200, node.Info())
 }
 
 type ProductStatusData struct {
@@ -40,17 +45,11 @@ func GetProductStatus(c *gin.Context, node *Node) {
 	var productStatus ProductStatusData
 	c.BindJSON(&productStatus)
 	status, _ := node.GetStatusOfProduct(productStatus.ProductId)
+	recall, _ := node.GetProductRecall(productStatus.ProductId)
 
-	statusString := ""
-	switch status {
-	case 0:
+	statusString := node.Lifecycle.StateName(status)
+	if status == core.StatusNone {
 		statusString = "Product Not Manufactured"
-	case core.Manufactured:
-		statusString = "Manufactured"
-	case core.Dispatched:
-		statusString = "Dispatched"
-	case core.Received:
-		statusString = "Delivered"
 	}
 
 	img, err := qrcode.Encode(statusString, qrcode.Medium, 512)
@@ -62,34 +61,306 @@ func GetProductStatus(c *gin.Context, node *Node) {
 	imgBytes := base64.StdEncoding.EncodeToString(img)
 
 	c.HTML(200, "qrcode.html", gin.H{
-		"image": imgBytes,
+		"image":  imgBytes,
+		"recall": recall,
+	})
+}
+
+// Get the custody trail of the product as JSON
+func GetProductHistory(c *gin.Context, node *Node) {
+	var productStatus ProductStatusData
+	c.BindJSON(&productStatus)
+
+	history, err := node.GetProductHistory(productStatus.ProductId)
+	if err != nil {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"productid": productStatus.ProductId,
+		"history":   history,
+	})
+}
+
+// Get the current holder of the product and the list of its custody transfers
+func GetProductCustody(c *gin.Context, node *Node) {
+	var productStatus ProductStatusData
+	c.BindJSON(&productStatus)
+
+	holder, hops, err := node.GetProductCustody(productStatus.ProductId)
+	if err != nil {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"productid": productStatus.ProductId,
+		"holder":    holder,
+		"hops":      hops,
+	})
+}
+
+// Accept the pending offer of the product to this node
+func AcceptOffer(c *gin.Context, node *Node) {
+	respondToOffer(c, node, core.Accept)
+}
+
+// Reject the pending offer of the product to this node
+func RejectOffer(c *gin.Context, node *Node) {
+	respondToOffer(c, node, core.Reject)
+}
+
+func respondToOffer(c *gin.Context, node *Node, kind core.TransactionKind) {
+	var productStatus ProductStatusData
+	c.BindJSON(&productStatus)
+
+	transaction, err := node.RespondToOffer(productStatus.ProductId, kind)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, transaction)
+}
+
+type ShipmentsData struct {
+	NodeID string `json:"nodeid"`
+}
+
+// List the open shipments of the given node or of this node if no node is given
+func GetOpenShipments(c *gin.Context, node *Node) {
+	var shipmentsData ShipmentsData
+	c.BindJSON(&shipmentsData)
+
+	nodeID := shipmentsData.NodeID
+	if nodeID == "" {
+		nodeID = node.ID
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"nodeid":    nodeID,
+		"shipments": node.GetOpenShipments(nodeID),
+	})
+}
+
+type PackData struct {
+	ProductId string   `json:"productid"`
+	Products  []string `json:"products"`
+}
+
+// Pack the products in the product
+func PackProducts(c *gin.Context, node *Node) {
+	packProducts(c, node, core.Pack)
+}
+
+// Unpack the products from the product
+func UnpackProducts(c *gin.Context, node *Node) {
+	packProducts(c, node, core.Unpack)
+}
+
+func packProducts(c *gin.Context, node *Node, kind core.TransactionKind) {
+	var packData PackData
+	c.BindJSON(&packData)
+
+	transaction, err := node.PackProducts(packData.ProductId, packData.Products, kind)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, transaction)
+}
+
+type TransactionProofData struct {
+	TxID []byte `json:"txid"`
+}
+
+// Recall the product and all the products packed in it
+func RecallProduct(c *gin.Context, node *Node) {
+	var productStatus ProductStatusData
+	c.BindJSON(&productStatus)
+
+	transaction, err := node.RecallProduct(productStatus.ProductId)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, transaction)
+}
+
+// Get the recall of the product, if it has been recalled
+func GetProductRecall(c *gin.Context, node *Node) {
+	var productStatus ProductStatusData
+	c.BindJSON(&productStatus)
+
+	recall, err := node.GetProductRecall(productStatus.ProductId)
+	if err != nil {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"productid": productStatus.ProductId,
+		"recalled":  recall != nil,
+		"recall":    recall,
+	})
+}
+
+type StakeData struct {
+	Amount uint64 `json:"amount"`
+}
+
+func SubmitStake(c *gin.Context, node *Node) {
+	var stakeData StakeData
+	c.BindJSON(&stakeData)
+
+	transaction, err := node.SubmitStake(stakeData.Amount)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, transaction)
+}
+
+type VoteData struct {
+	// Candidates voted for, the earlier vote is withdrawn if there are none
+	Candidates []string `json:"candidates"`
+}
+
+func SubmitVote(c *gin.Context, node *Node) {
+	var voteData VoteData
+	c.BindJSON(&voteData)
+
+	transaction, err := node.SubmitVote(voteData.Candidates)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, transaction)
+}
+
+func GetElection(c *gin.Context, node *Node) {
+	c.IndentedJSON(200, gin.H{
+		"epoch":       node.State().CurrentEpoch(),
+		"epochlength": node.Election.EpochLength,
+		"verifiers":   node.Dpos.GetVerifiers(),
+		"tally":       node.State().Tally(),
+	})
+}
+
+// Verifier scheduled to propose the block at a height
+type ScheduledProposer struct {
+	Height   uint   `json:"height"`
+	Proposer string `json:"proposer"`
+}
+
+func GetSchedule(c *gin.Context, node *Node) {
+	next := node.Blockchain.Tip().Height + 1
+	view := node.CurrentView()
+	verifiers := node.Dpos.GetVerifiers()
+
+	schedule := make([]ScheduledProposer, 0, len(verifiers))
+	for height := next; height < next+uint(len(verifiers)); height++ {
+		schedule = append(schedule, ScheduledProposer{
+			Height:   height,
+			Proposer: node.Dpos.ProposerFor(core.CurrentBlockVersion, height, view),
+		})
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"slot":         time.Now().UnixMilli() / node.SlotDuration.Milliseconds(),
+		"slotduration": node.SlotDuration.Milliseconds(),
+		"view":         view,
+		"schedule":     schedule,
+	})
+}
+
+func GetConsensusMetrics(c *gin.Context, node *Node) {
+	metrics := node.Dpos.Metrics.Snapshot()
+
+	c.IndentedJSON(200, gin.H{
+		"height":       node.Blockchain.Tip().Height + 1,
+		"view":         node.CurrentView(),
+		"skippedslots": metrics.SkippedSlots,
+		"viewchanges":  metrics.ViewChanges,
+		"missedturns":  metrics.MissedTurns,
+	})
+}
+
+// Get the merkle proof of inclusion of a transaction along with the header of its block
+func GetTransactionProof(c *gin.Context, node *Node) {
+	var proofData TransactionProofData
+	c.BindJSON(&proofData)
+
+	block, _, err := node.FindTransaction(proofData.TxID)
+	if err != nil {
+		c.IndentedJSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	proof, err := block.MerkleTree().Proof(proofData.TxID)
+	if err != nil {
+		c.IndentedJSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(200, gin.H{
+		"header": block.Header(),
+		"proof":  proof,
 	})
 }
 
 func Dispute(c *gin.Context, node *Node) {
 	var productStatus ProductStatusData
 	c.BindJSON(&productStatus)
-	status, _ := node.GetStatusOfProduct(productStatus.ProductId)
+	product, ok := node.State().Product(productStatus.ProductId)
 
-	if status == 0 {
+	if !ok || product.Status == core.StatusNone {
 		// Product not yet made or sent to distributor
 		c.IndentedJSON(200, gin.H{
 			"error": "product not found",
 		})
-	} else if status == core.Received {
-		// Consumer is wrong, product is dispatched
-		node.Network.Broadcast("dispute", []byte(node.ID))
-		logger.LogInfo("Consumer is wrong, stake is being deducted\n")
+	} else if node.WasDelivered(product) {
+		// Consumer is wrong, the product was delivered even if it has been returned since
+		logger.LogInfo("Consumer is wrong\n")
+		node.OnDispute(productStatus.ProductId, node.ID)
 		c.IndentedJSON(200, gin.H{
-			"error": "Consumer is wrong, stake is being deducted",
+			"error": "Consumer is wrong",
 		})
 	} else {
-		// Distributor is wrong
-		tx, _ := node.GetTransactionOfProduct(productStatus.ProductId)
-		logger.LogInfo("Distributor is wrong, stake is being deducted\n")
-		node.Network.Broadcast("dispute", []byte(tx.Sender))
+		// Distributor is wrong, the product was last handed over by the distributor
+		distributor := product.LastTransaction.Sender
+		if len(product.Hops) > 0 {
+			distributor = product.Hops[len(product.Hops)-1].From
+		}
+		logger.LogInfo("Distributor is wrong\n")
+		node.OnDispute(productStatus.ProductId, distributor)
 		c.IndentedJSON(200, gin.H{
-			"error": "Distributor is wrong, stake is being deducted",
+			"error": "Distributor is wrong",
 		})
 	}
 }
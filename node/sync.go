@@ -0,0 +1,289 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Animesh-03/scms/core"
+	"github.com/Animesh-03/scms/logger"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	SyncProtocol = "/scms/sync/1.0.0"
+	// Maximum number of blocks sent in response to a single request
+	SyncBatchSize = 50
+)
+
+type SyncRequestType string
+
+const (
+	SyncTip           SyncRequestType = "tip"
+	SyncBlocks        SyncRequestType = "blocks"
+	SyncRegistrations SyncRequestType = "registrations"
+)
+
+type SyncRequest struct {
+	Type SyncRequestType `json:"type"`
+	From uint            `json:"from"`
+	To   uint            `json:"to"`
+}
+
+type SyncTipResponse struct {
+	Height uint   `json:"height"`
+	Hash   []byte `json:"hash"`
+}
+
+// Serve the sync requests of the other nodes
+// 1. tip: respond with the height and hash of the tip
+// 2. blocks: respond with the blocks in the range [From, To]
+// 3. registrations: respond with the stakes, public keys and roles known to the node
+func SyncStreamHandler(stream network.Stream, node *Node) {
+	defer stream.Close()
+
+	line, err := bufio.NewReader(stream).ReadBytes('\n')
+	if err != nil {
+		logger.LogError("Error reading sync request: %s\n", err)
+		return
+	}
+
+	var req SyncRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		logger.LogError("Error unmarshalling sync request: %s\n", err)
+		return
+	}
+
+	// Blocks are sent in the binary encoding and the other responses as JSON
+	var res interface{}
+	switch req.Type {
+	case SyncTip:
+		tip := node.Blockchain.Tip()
+		res = SyncTipResponse{Height: tip.Height, Hash: tip.Hash}
+
+	case SyncBlocks:
+		if req.To < req.From || req.To-req.From >= SyncBatchSize {
+			req.To = req.From + SyncBatchSize - 1
+		}
+
+		blocks := make([]*core.Block, 0)
+		for height := req.From; height <= req.To; height++ {
+			block, err := node.Blockchain.GetByHeight(height)
+			if err != nil {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+		res = core.EncodeBlocks(blocks)
+
+	case SyncRegistrations:
+		res = node.registrations()
+
+	default:
+		logger.LogWarn("Unknown sync request: %s\n", req.Type)
+		return
+	}
+
+	resBytes, ok := res.([]byte)
+	if !ok {
+		resBytes, err = json.Marshal(res)
+		if err != nil {
+			logger.LogError("Error marshalling sync response: %s\n", err)
+			return
+		}
+	}
+
+	if _, err := stream.Write(resBytes); err != nil {
+		logger.LogError("Error writing sync response: %s\n", err)
+	}
+}
+
+// Send a sync request to the peer and return the raw response
+func (node *Node) syncRequest(p peer.ID, req SyncRequest) ([]byte, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.Network.Request(SyncProtocol, p, reqBytes)
+}
+
+// Send a sync request to the peer and unmarshal the JSON response into res
+func (node *Node) syncRequestJSON(p peer.ID, req SyncRequest, res interface{}) error {
+	resBytes, err := node.syncRequest(p, req)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(resBytes, res)
+}
+
+// Catch up with the peers by downloading the blocks missing from the local chain.
+// The registrations are synced first, even if the chain is up to date, as they are not stored by the node.
+// The peer with the highest tip is asked for the missing blocks in batches
+// and every block is verified before it is appended.
+func (node *Node) SyncChain() {
+	// Only a single sync runs at a time
+	if !node.syncMu.TryLock() {
+		return
+	}
+	defer node.syncMu.Unlock()
+
+	node.syncRegistrations()
+
+	var best peer.ID
+	var bestTip SyncTipResponse
+	for p := range node.Network.GetPeers() {
+		var tip SyncTipResponse
+		if err := node.syncRequestJSON(p, SyncRequest{Type: SyncTip}, &tip); err != nil {
+			logger.LogWarn("Error requesting tip from %s: %s\n", p, err)
+			continue
+		}
+
+		if tip.Height > bestTip.Height {
+			best, bestTip = p, tip
+		}
+	}
+
+	if bestTip.Height <= node.Blockchain.Tip().Height {
+		logger.LogInfo("Blockchain is up to date at height %d\n", node.Blockchain.Tip().Height)
+		return
+	}
+
+	logger.LogInfo("Syncing blocks %d to %d from %s\n", node.Blockchain.Tip().Height+1, bestTip.Height, best)
+
+	from := node.Blockchain.Tip().Height + 1
+	for from <= bestTip.Height {
+		req := SyncRequest{Type: SyncBlocks, From: from, To: from + SyncBatchSize - 1}
+		resBytes, err := node.syncRequest(best, req)
+		if err != nil {
+			logger.LogError("Error requesting blocks from %s: %s\n", best, err)
+			return
+		}
+
+		blocks, err := core.DecodeBlocks(resBytes)
+		if err != nil {
+			logger.LogError("Error decoding blocks from %s: %s\n", best, err)
+			return
+		}
+
+		if len(blocks) == 0 {
+			logger.LogWarn("Peer %s returned no blocks from height %d\n", best, from)
+			return
+		}
+
+		// The chain of the peer forked off below the requested range so step back
+		// until the fork point is found. The blocks received so far are kept in the
+		// side chain pool and are connected once their ancestors arrive.
+		connected := node.HasBlock(blocks[0].Hash) || node.HasBlock(blocks[0].PreviousBlockHash)
+
+		for _, block := range blocks {
+			err := node.AddBlockToBlockChain(block)
+			if err != nil && err != ErrDuplicateBlock && err != ErrOrphanBlock {
+				logger.LogError("Error syncing block %d from %s: %s\n", block.Height, best, err)
+				return
+			}
+		}
+
+		if !connected {
+			if from <= 1 {
+				logger.LogError("Peer %s has a different genesis block\n", best)
+				return
+			}
+			if from <= SyncBatchSize {
+				from = 1
+			} else {
+				from -= SyncBatchSize
+			}
+			continue
+		}
+
+		from = blocks[len(blocks)-1].Height + 1
+	}
+
+	logger.LogInfo("Synced blockchain to height %d\n", node.Blockchain.Tip().Height)
+}
+
+// Get the registrations of the nodes known to this node
+func (node *Node) registrations() []RegistrationData {
+	node.registryMu.RLock()
+	defer node.registryMu.RUnlock()
+
+	registrations := make([]RegistrationData, 0, len(node.PubKeyMap))
+	for id, pubKey := range node.PubKeyMap {
+		// The curve is always P256 and cannot be unmarshalled
+		pubKey.Curve = nil
+		registrations = append(registrations, RegistrationData{
+			PeerId:    id,
+			Amount:    node.Dpos.RegisteredStake(id),
+			PublicKey: pubKey,
+			Role:      node.RoleMap[id],
+		})
+	}
+
+	return registrations
+}
+
+// Learn the stakes and public keys of the nodes that registered before this node joined.
+// Every peer is asked for its registrations and a registration is only accepted if more than
+// half of the peers report the same public key and role for the node. Registrations of nodes
+// that are already known are never overwritten.
+func (node *Node) syncRegistrations() {
+	peers := node.Network.GetPeers()
+
+	reports := make(map[string]int)
+	reported := make(map[string]RegistrationData)
+	for p := range peers {
+		var registrations []RegistrationData
+		if err := node.syncRequestJSON(p, SyncRequest{Type: SyncRegistrations}, &registrations); err != nil {
+			logger.LogWarn("Error syncing registrations from %s: %s\n", p, err)
+			continue
+		}
+
+		// A peer is only counted once for every registration it reports
+		seen := make(map[string]bool)
+		for _, registration := range registrations {
+			if registration.PublicKey.X == nil || registration.PublicKey.Y == nil {
+				continue
+			}
+
+			key := registrationKey(registration)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			reports[key]++
+			reported[key] = registration
+		}
+	}
+
+	for key, count := range reports {
+		registration := reported[key]
+		if count <= len(peers)/2 {
+			logger.LogWarn("Ignoring registration of %s reported by %d of %d peers\n", registration.PeerId, count, len(peers))
+			continue
+		}
+		node.learnRegistration(registration)
+	}
+}
+
+// Store the registration of a node unless the node is already known
+func (node *Node) learnRegistration(registration RegistrationData) {
+	node.registryMu.Lock()
+	defer node.registryMu.Unlock()
+
+	if _, ok := node.PubKeyMap[registration.PeerId]; ok {
+		return
+	}
+
+	node.PubKeyMap[registration.PeerId] = registration.PublicKey
+	node.RoleMap[registration.PeerId] = registration.Role
+	node.Dpos.RegisterStake(registration)
+}
+
+// Identity of a registration which the peers must agree on
+func registrationKey(registration RegistrationData) string {
+	return fmt.Sprintf("%s|%s|%x|%x", registration.PeerId, registration.Role, registration.PublicKey.X, registration.PublicKey.Y)
+}
@@ -1,11 +1,12 @@
 package node
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math"
+	"time"
 
 	"github.com/Animesh-03/scms/core"
 	"github.com/Animesh-03/scms/logger"
@@ -15,91 +16,362 @@ import (
 
 // Check the status of the given product by the product ID
 func (n *Node) GetStatusOfProduct(productId string) (core.TransactionStatus, error) {
-	if productId == "" {
+	product, ok := n.State().Product(productId)
+	if !ok || product.Status == core.StatusNone {
 		return 0, errors.New("product not found")
 	}
 
-	status := uint16(0)
-	for _, block := range n.Blockchain {
-		for _, tx := range block.Transactions {
-			if tx.ProductID == productId {
-				status = uint16(math.Max(float64(status), float64(tx.Status)))
-			}
+	return product.Status, nil
+}
+
+func (n *Node) GetTransactionOfProduct(productId string) (*core.Transaction, error) {
+	product, ok := n.State().Product(productId)
+	if !ok {
+		return nil, nil
+	}
+
+	return product.LastTransaction, nil
+}
+
+// Transaction in the custody trail of a product
+type ProvenanceRecord struct {
+	TxID           []byte                 `json:"txid"`
+	Sender         string                 `json:"sender"`
+	Receiver       string                 `json:"receiver"`
+	Status         core.TransactionStatus `json:"status"`
+	Kind           core.TransactionKind   `json:"kind"`
+	BlockHeight    uint                   `json:"blockheight"`
+	BlockTimestamp int64                  `json:"blocktimestamp"`
+	ValidSignature bool                   `json:"validsignature"`
+}
+
+// Get the transactions of the given product in the order they were added to the chain
+func (n *Node) GetProductHistory(productId string) ([]ProvenanceRecord, error) {
+	product, ok := n.State().Product(productId)
+	if !ok {
+		return nil, errors.New("product not found")
+	}
+
+	history := make([]ProvenanceRecord, 0, len(product.History))
+	for _, event := range product.History {
+		tx := event.Transaction
+		// The signature can only be checked if the sender is registered
+		pubKey, registered := n.PublicKey(tx.Sender)
+
+		history = append(history, ProvenanceRecord{
+			TxID:           tx.ID,
+			Sender:         tx.Sender,
+			Receiver:       tx.Receiver,
+			Status:         tx.Status,
+			Kind:           tx.Kind,
+			BlockHeight:    event.BlockHeight,
+			BlockTimestamp: event.BlockTimestamp,
+			ValidSignature: registered && tx.Verify(pubKey),
+		})
+	}
+
+	return history, nil
+}
+
+// Get the current holder of the product and every transfer of its custody in order
+func (n *Node) GetProductCustody(productId string) (string, []core.CustodyHop, error) {
+	product, ok := n.State().Product(productId)
+	if !ok {
+		return "", nil, errors.New("product not found")
+	}
+
+	return product.Holder, product.Hops, nil
+}
+
+// Get the products of the open shipments of the node
+func (n *Node) GetOpenShipments(nodeID string) []*core.ProductState {
+	shipments := make([]*core.ProductState, 0)
+	for _, productID := range n.State().OpenShipments(nodeID) {
+		if product, ok := n.State().Product(productID); ok {
+			shipments = append(shipments, product)
 		}
 	}
 
-	if status == 0 {
-		return 0, errors.New("product not found")
+	return shipments
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	return core.TransactionStatus(status), nil
+
+	return false
 }
 
-func (n *Node) GetTransactionOfProduct(productId string) (*core.Transaction, error) {
-	if productId == "" {
-		return nil, errors.New("product not found")
+// Find the block of the chain which contains the transaction with the given ID
+func (n *Node) FindTransaction(txID []byte) (*core.Block, *core.Transaction, error) {
+	height, ok := n.State().TransactionHeight(txID)
+	if !ok {
+		return nil, nil, errors.New("transaction not found")
 	}
 
-	var txn *core.Transaction
-	for _, block := range n.Blockchain {
-		for _, tx := range block.Transactions {
-			if tx.ProductID == productId {
-				txn = tx
-			}
+	block, err := n.Blockchain.GetByHeight(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return block, tx, nil
 		}
 	}
 
-	return txn, nil
+	return nil, nil, errors.New("transaction not found")
 }
 
-// Broadcast a transaction with status based on the type of node
-func (n *Node) MakeTransaction(receiver, productId string) (*core.Transaction, error) {
+// Get the nonce for the next transaction of this node which must be greater
+// than the nonces of its transactions on the chain and in the mempool
+func (n *Node) NextNonce() uint64 {
+	n.nonceMu.Lock()
+	defer n.nonceMu.Unlock()
+
+	if nonce := n.State().Nonce(n.ID); nonce > n.nonce {
+		n.nonce = nonce
+	}
+	if nonce := n.MemPool.MaxNonce(n.ID); nonce > n.nonce {
+		n.nonce = nonce
+	}
+
+	n.nonce++
+	return n.nonce
+}
+
+// Broadcast a transaction which moves the product to the given state of the lifecycle.
+// If no state is given, the only state the role of this node can move the product to is used.
+// If the transition transfers custody, the product is offered to the receiver and only moves
+// when the receiver accepts the offer. If products are given, a new lot with the ID of the product
+// is created which contains the products.
+func (n *Node) MakeTransaction(receiver, productId, state string, products []string) (*core.Transaction, error) {
+	current, _ := n.GetStatusOfProduct(productId)
+
+	var status core.TransactionStatus
+	if state == "" {
+		next := n.Lifecycle.NextStates(current, n.Role)
+		if len(next) == 0 {
+			return nil, fmt.Errorf("product %s can not be moved from %s by a %s", productId, n.Lifecycle.StateName(current), n.Role)
+		}
+		if len(next) > 1 {
+			return nil, fmt.Errorf("product %s can be moved to more than one state, the state must be given", productId)
+		}
+		status = next[0]
+	} else {
+		var ok bool
+		if status, ok = n.Lifecycle.Status(state); !ok {
+			return nil, fmt.Errorf("unknown state %s", state)
+		}
+	}
+
+	if err := n.Lifecycle.CanTransition(current, status, n.Role); err != nil {
+		return nil, fmt.Errorf("product %s can not be moved from %s to %s: %w", productId, n.Lifecycle.StateName(current), n.Lifecycle.StateName(status), err)
+	}
+
+	// Only the current holder can move a product that exists
+	if product, ok := n.State().Product(productId); ok {
+		if product.Container != "" {
+			return nil, fmt.Errorf("product %s can only be moved with %s which it is packed in", productId, product.Container)
+		}
+		if product.Holder != n.ID {
+			return nil, fmt.Errorf("product %s is held by %s", productId, product.Holder)
+		}
+		if len(products) > 0 {
+			return nil, fmt.Errorf("lot %s already exists", productId)
+		}
+	}
+
+	kind := core.Transfer
+	if transition, _ := n.Lifecycle.Transition(current, status); transition.TransfersCustody {
+		kind = core.Offer
+
+		// Offering the product opens a new shipment unless this node already ships it
+		shipments := n.State().OpenShipments(n.ID)
+		if n.MaxShipments > 0 && uint(len(shipments)) >= n.MaxShipments && !contains(shipments, productId) {
+			return nil, fmt.Errorf("%d shipments are already open", len(shipments))
+		}
+	}
+
 	var transaction *core.Transaction
+	if len(products) > 0 {
+		transaction = core.NewLotTransaction(kind, n.ID, receiver, productId, products, status, n.NextNonce(), n.ChainID)
+	} else {
+		transaction = core.NewTransaction(kind, n.ID, receiver, productId, status, n.NextNonce(), n.ChainID)
+	}
+	n.SignTransaction(transaction)
+
+	n.Network.Broadcast("transaction", transaction.Encode())
+
+	return transaction, nil
+}
+
+// Broadcast a transaction which registers the role of this node on the chain
+func (n *Node) RegisterRole() (*core.Transaction, error) {
+	transaction := core.NewRegisterTransaction(n.ID, n.Role, n.NextNonce(), n.ChainID)
+	if err := n.State().CheckTransitions(core.CurrentBlockVersion, n.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, n.Roles()); err != nil {
+		return nil, err
+	}
+	n.SignTransaction(transaction)
+
+	n.Network.Broadcast("transaction", transaction.Encode())
+
+	return transaction, nil
+}
+
+// Broadcast a transaction which packs the products in the container or unpacks them from it.
+// Packing does not change the status of the products.
+func (n *Node) PackProducts(containerId string, products []string, kind core.TransactionKind) (*core.Transaction, error) {
+	if len(products) == 0 {
+		return nil, errors.New("no products to pack")
+	}
+
+	// The status of the transaction is the status of the container or of the products packed in a new container
+	statusOf := containerId
+	if _, ok := n.State().Product(containerId); !ok {
+		statusOf = products[0]
+	}
+	product, ok := n.State().Product(statusOf)
+	if !ok {
+		return nil, fmt.Errorf("product %s not found", statusOf)
+	}
+
+	transaction := core.NewLotTransaction(kind, n.ID, n.ID, containerId, products, product.Status, n.NextNonce(), n.ChainID)
+	if err := n.State().CheckTransitions(core.CurrentBlockVersion, n.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, n.Roles()); err != nil {
+		return nil, err
+	}
+	n.SignTransaction(transaction)
+
+	n.Network.Broadcast("transaction", transaction.Encode())
 
-	switch n.Type {
-	case Manufacturer:
-		status, _ := n.GetStatusOfProduct(productId)
-		if status == 0 {
-			transaction = core.NewTransaction(n.ID, receiver, productId, core.Manufactured)
-		} else {
-			return nil, fmt.Errorf("product %s already exists", productId)
+	return transaction, nil
+}
+
+// Get the products whose return was received in the block, which must be the last block applied to the state
+func (n *Node) Refunds(state *core.State, block *core.Block) []*core.ProductState {
+	var refunds []*core.ProductState
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if seen[tx.ProductID] {
+			continue
 		}
+		seen[tx.ProductID] = true
 
-	case Distribtor:
-		// Check if a previous product is still progress
-		status, _ := n.GetStatusOfProduct(n.CurrentProduct)
-		status1, _ := n.GetStatusOfProduct(productId)
-		if status1 == core.Manufactured && (status == core.Received || n.CurrentProduct == "") {
-			transaction = core.NewTransaction(n.ID, receiver, productId, core.Dispatched)
-			n.CurrentProduct = productId
-		} else if status1 != core.Manufactured {
-			return nil, fmt.Errorf("product %s not yet manufactured", productId)
-		} else {
-			return nil, fmt.Errorf("previous product %s still in progress", n.CurrentProduct)
+		product, ok := state.Product(tx.ProductID)
+		if ok && product.Return != nil && product.Return.Refunded && product.Return.RefundHeight == block.Height {
+			refunds = append(refunds, product)
 		}
+	}
 
-	case Consumer:
-		status, _ := n.GetStatusOfProduct(productId)
+	return refunds
+}
+
+// Call the refund hook for every product whose return was received.
+// A return is notified only once, even if its block is rolled back and the return is received again.
+func (n *Node) NotifyRefunds(refunds []*core.ProductState) {
+	if n.OnRefund == nil {
+		return
+	}
 
-		if status == 0 {
-			return nil, fmt.Errorf("product %s not found", productId)
+	n.refundMu.Lock()
+	defer n.refundMu.Unlock()
+	if n.refunded == nil {
+		n.refunded = make(map[string]bool)
+	}
+
+	for _, product := range refunds {
+		returnID := hex.EncodeToString(product.Return.TxID)
+		if n.refunded[returnID] {
+			continue
 		}
+		n.refunded[returnID] = true
+		n.OnRefund(product)
+	}
+}
+
+// Default refund hook which logs the refund that is owed to the consumer
+func (n *Node) LogRefund(product *core.ProductState) {
+	logger.LogInfo("Return of product %s received by %s, refund is owed to %s\n", product.ProductID, product.Holder, product.Return.Consumer)
+}
+
+// Default dispute hook which logs the node against which the dispute was decided
+func (n *Node) LogDispute(productId string, nodeID string) {
+	logger.LogWarn("Dispute on product %s decided against %s\n", productId, nodeID)
+}
 
-		if status != core.Dispatched {
-			return nil, fmt.Errorf("product %s not dispatched", productId)
+// Check if the product was delivered to the consumer at any point of its history.
+// A product that is returned can be in a state which is not a delivered state.
+func (n *Node) WasDelivered(product *core.ProductState) bool {
+	for _, event := range product.History {
+		// Offers which were not accepted did not move the product
+		kind := event.Transaction.Kind
+		if kind != core.Offer && kind != core.Reject && n.Lifecycle.IsDelivered(event.Transaction.Status) {
+			return true
 		}
+	}
+
+	return false
+}
 
-		transaction = core.NewTransaction(n.ID, receiver, productId, core.Received)
+// Broadcast a transaction which recalls the product and all the products packed in it.
+// Only the manufacturer of the product can recall it.
+func (n *Node) RecallProduct(productId string) (*core.Transaction, error) {
+	product, ok := n.State().Product(productId)
+	if !ok {
+		return nil, fmt.Errorf("product %s not found", productId)
+	}
+	if product.Manufacturer != n.ID {
+		return nil, fmt.Errorf("product %s was manufactured by %s", productId, product.Manufacturer)
+	}
+	if product.Recall != nil {
+		return nil, fmt.Errorf("product %s has already been recalled", productId)
 	}
 
+	transaction := core.NewTransaction(core.Recall, n.ID, n.ID, productId, product.Status, n.NextNonce(), n.ChainID)
+	if err := n.State().CheckTransitions(core.CurrentBlockVersion, n.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, n.Roles()); err != nil {
+		return nil, err
+	}
 	n.SignTransaction(transaction)
 
-	transactionBytes, err := json.Marshal(transaction)
+	n.Network.Broadcast("transaction", transaction.Encode())
+
+	return transaction, nil
+}
+
+// Get the recall of the product, or nil if it has not been recalled
+func (n *Node) GetProductRecall(productId string) (*core.ProductRecall, error) {
+	product, ok := n.State().Product(productId)
+	if !ok {
+		return nil, errors.New("product not found")
+	}
+
+	return product.Recall, nil
+}
+
+// Broadcast a transaction which accepts or rejects the pending offer of the product to this node
+func (n *Node) RespondToOffer(productId string, kind core.TransactionKind) (*core.Transaction, error) {
+	product, ok := n.State().Product(productId)
+	if !ok || product.Offer == nil {
+		return nil, fmt.Errorf("product %s has no pending offer", productId)
+	}
+	if product.Offer.To != n.ID {
+		return nil, fmt.Errorf("offer of product %s is for %s", productId, product.Offer.To)
+	}
+	if kind == core.Accept && product.Offer.Expired(n.Blockchain.Tip().Height+1, n.Lifecycle.OfferExpiry) {
+		return nil, fmt.Errorf("offer of product %s has expired", productId)
+	}
+
+	_, offer, err := n.FindTransaction(product.Offer.TxID)
 	if err != nil {
-		logger.LogError("error marshalling transaction: %s", err.Error())
 		return nil, err
 	}
 
-	n.Network.Broadcast("transaction", transactionBytes)
+	transaction := core.NewOfferResponse(kind, n.ID, offer, n.NextNonce(), n.ChainID)
+	n.SignTransaction(transaction)
+
+	n.Network.Broadcast("transaction", transaction.Encode())
 
 	return transaction, nil
 }
@@ -111,15 +383,37 @@ func TransactionHandler(sub *pubsub.Subscription, self peer.ID, node *Node) {
 			logger.LogError("Error reading from %s\n", sub.Topic())
 			return
 		}
-		logger.LogInfo("Received Transaction from %s:\n%s\n", msg.ReceivedFrom.String(), msg.GetData())
+		transaction, err := core.DecodeTransaction(msg.Data)
+		if err != nil {
+			logger.LogWarn("Error decoding transaction from %s: %s\n", msg.ReceivedFrom.String(), err.Error())
+			continue
+		}
 
-		var transaction core.Transaction
-		json.Unmarshal(msg.Data, &transaction)
+		logger.LogInfo("Received Transaction from %s:\n%s\n", msg.ReceivedFrom.String(), transaction.Stringify())
 
-		if transaction.Verify(node.PubKeyMap[transaction.Sender]) {
-			node.MemPool.AddToPool(&transaction)
-		} else {
+		pubKey, ok := node.PublicKey(transaction.Sender)
+		if !ok || !transaction.Verify(pubKey) {
 			logger.LogWarn("Transaction Invalid: %s", transaction.Stringify())
+			continue
+		}
+
+		// Reject transactions that replay an earlier transaction of the sender
+		if err := node.State().CheckReplay(transaction, time.Now().UnixMilli()); err != nil {
+			logger.LogWarn("Transaction Rejected: %s: %s", err.Error(), transaction.Stringify())
+			continue
+		}
+		if node.MemPool.HasNonce(transaction.Sender, transaction.Nonce) {
+			logger.LogWarn("Transaction Rejected: %s: %s", core.ErrStaleNonce.Error(), transaction.Stringify())
+			continue
 		}
+
+		// Reject transactions that break the lifecycle or are not sent by the holder of the product
+		// or by a node whose role may perform them
+		if err := node.State().CheckTransitions(core.CurrentBlockVersion, node.Blockchain.Tip().Height+1, []*core.Transaction{transaction}, node.Roles()); err != nil {
+			logger.LogWarn("Transaction Rejected: %s: %s", err.Error(), transaction.Stringify())
+			continue
+		}
+
+		node.MemPool.AddToPool(transaction)
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/Animesh-03/scms/logger"
 	"github.com/libp2p/go-libp2p"
@@ -114,7 +116,7 @@ func (n *MDNSNetwork) ListenBroadcast(topic string, handler func(sub *pubsub.Sub
 }
 
 func (n *MDNSNetwork) Broadcast(topic string, msg []byte) {
-	logger.LogInfo("Broadcasting %s\n", string(msg))
+	logger.LogInfo("Broadcasting %d bytes on %s\n", len(msg), topic)
 	_, ok := n.topics[topic]
 
 	if !ok {
@@ -164,6 +166,31 @@ func (n *MDNSNetwork) SendTo(proto string, p peer.ID, msg string) {
 	}
 }
 
+// Time after which a request to a peer is abandoned
+const RequestTimeout = 30 * time.Second
+
+// Send a request privately to the peer and wait for its response.
+// The handler of the protocol on the peer reads the request until the end of the line
+// and the response is read until the peer closes the stream.
+func (n *MDNSNetwork) Request(proto string, p peer.ID, msg []byte) ([]byte, error) {
+	stream, err := n.h.NewStream(context.Background(), p, protocol.ID(proto))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(RequestTimeout))
+
+	if _, err := stream.Write(append(msg, '\n')); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(stream)
+}
+
 func (n *MDNSNetwork) GetNumberOfPeers() int {
 	return len(n.peers)
 }
@@ -15,6 +15,7 @@ type Network interface {
 	GetPeers() map[peer.ID]*peer.AddrInfo
 	Init(config NetworkConfig)
 	ListenBroadcast(topic string, handler func(sub *pubsub.Subscription, self peer.ID))
+	Request(proto string, p peer.ID, msg []byte) ([]byte, error)
 	SendTo(proto string, p peer.ID, msg string)
 }
 